@@ -3,240 +3,3490 @@ package csv
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"errors"
+	"fmt"
 	"io"
+	"iter"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Config struct {
 	// When true, leading and trailing spaces are trimmed form
 	// unquoted fields.
 	TrimSpaces bool
+	// When non-empty, leading and trailing runes found in
+	// TrimCutset are trimmed from unquoted fields, in place of
+	// the spaces trimmed by TrimSpaces.
+	TrimCutset string
+	// When true, leading and trailing whitespace, or the runes in
+	// TrimCutset if set, are trimmed from quoted fields too.
+	TrimQuoted bool
 	// Byte that separates fields in a row. Usually ','.
 	FieldDelim byte
+	// When non-zero, used in place of FieldDelim so that fields
+	// may be separated by a non-ASCII character such as '§'.
+	FieldDelimRune rune
+	// When non-empty, used in place of FieldDelim and
+	// FieldDelimRune so that fields may be separated by a
+	// multi-character string such as "||".
+	FieldDelimString string
+	// Byte that ends a row when reading. Usually '\n', in which
+	// case "\r\n" and a lone '\r' are accepted as well. A zero
+	// value is treated as '\n'.
+	RecordDelim byte
+	// When true, rows end with a NUL byte when reading, which a
+	// zero RecordDelim cannot stand for. RecordDelim is ignored.
+	RecordDelimNUL bool
+	// When true, the Writer ends rows with "\r\n" rather than '\n'.
+	UseCRLF bool
+	// When positive, the Writer pads rows shorter than PadRowsTo
+	// with empty fields. Longer rows fail with a *FieldCountError,
+	// or with TruncateRows set have their extra fields dropped.
+	PadRowsTo int
+	// When true, WriteRowMap fails with an *UnknownKeyError on
+	// keys that are not in the header.
+	RejectUnknownKeys bool
+	// When true, the Writer puts FormulaGuard ahead of fields that
+	// start with '=', '+', '-', '@', a tab or a carriage return,
+	// so that spreadsheets don't run them as formulas. Numbers such
+	// as "-42" are left alone.
+	SanitizeFormulas bool
+	// Byte put ahead of fields by SanitizeFormulas. A zero value is
+	// treated as '\''.
+	FormulaGuard byte
+	// When true, the Writer leaves out the end of the last row. The
+	// end of each row is written only once another row follows.
+	NoFinalNewline bool
+	// How WriteRowAny formats floats.
+	FloatFormat FloatFormat
+	// How WriteRowAny writes bools. The zero value writes "true"
+	// and "false".
+	BoolFormat BoolFormat
+	// Layout WriteRowAny formats times with, and struct fields
+	// without a layout of their own are read with. Usually empty,
+	// for time.RFC3339Nano.
+	TimeLayout string
+	// When non-nil, times are converted to TimeLocation before
+	// being formatted, and times read without a zone are taken to
+	// be in TimeLocation rather than UTC.
+	TimeLocation *time.Location
+	// When true, zero times are formatted like any other time
+	// rather than written as empty fields.
+	FormatZeroTime bool
+	// When true, the Writer starts its output with a UTF-8 byte
+	// order mark, as Excel needs to tell that a file is UTF-8. It is
+	// written only once, even if the Writer is Reset, and not at
+	// all when OpenAppend adds to a file that is not empty.
+	WriteBOM bool
+	// When non-empty, the Writer ends rows with RecordDelimOut,
+	// such as "\x00", in place of '\n' or "\r\n".
+	RecordDelimOut string
+	// When true, a first line of the form "sep=X", as written by
+	// Excel, is consumed and X becomes the field delimiter.
+	HonorSepDirective bool
+	// Number of lines at the start of the input to discard
+	// without parsing, such as a free-form preamble before the
+	// header row.
+	SkipLines int
+	// When non-empty, the first row whose first field starts with
+	// StopAtPrefix ends the input. Nothing after it is read, and
+	// the row itself is available from Reader.Footer.
+	StopAtPrefix string
+	// When true, empty lines are skipped, as are lines holding
+	// only spaces when TrimSpaces is also set.
+	SkipBlankLines bool
+	// When true, a run of consecutive field delimiters separates
+	// just two fields, and delimiters at the start or end of a
+	// row don't make empty fields.
+	CollapseDelims bool
+	// When non-zero, an unquoted InlineComment byte and the rest
+	// of the line after it are ignored.
+	InlineComment byte
+	// When non-zero, the byte following Escape is taken literally
+	// rather than as a delimiter or quote. Escape followed by 'n',
+	// 'r' or 't' stands for a newline, carriage return or tab.
+	// The Writer precedes Escape in fields with Escape, quoted or
+	// not.
+	Escape byte
+	// When true, the Writer protects delimiters, quotes, line
+	// breaks and Escape itself in fields by preceding them with
+	// Escape instead of quoting the field, as read back with the
+	// same Escape. Quoting is then ignored, but for empty fields
+	// quoted because of EmptyUnquotedAs.
+	PreferEscape bool
+	// When non-zero, rows whose first non-space byte is Comment
+	// are skipped entirely.
+	Comment byte
+	// Byte used to quote fields. Usually '"'. A zero value is
+	// treated as '"'.
+	QuoteChar byte
+	// When true, a quoted field containing '\n' or '\r' is
+	// rejected with a *ParseError, so that each row is exactly one
+	// line of input.
+	DisallowQuotedNewlines bool
+	// When fields are quoted when writing. The zero value is
+	// QuoteMinimal.
+	Quoting Quoting
+	// When true, the Writer writes line breaks in fields as `\n`,
+	// or `\r` for a lone '\r', and backslashes as `\\`, so that
+	// each row is one line. The Reader turns them back. Not to be
+	// combined with an Escape of '\\', which does the same.
+	EscapeNewlines bool
+	// When true, "\r\n" and lone '\r' line breaks inside quoted
+	// fields are read as '\n'.
+	NormalizeQuotedNewlines bool
+	// When true, a quote may appear in an unquoted field and a
+	// non-doubled quote may appear in a quoted field.
+	LazyQuotes bool
+	// When true, input that is not strictly RFC 4180 is rejected
+	// with a *ParseError: quotes in unquoted fields, anything
+	// between a closing quote and the delimiter, lone '\r' line
+	// endings, and rows of differing lengths when FieldsPerRecord
+	// is negative. LazyQuotes is ignored.
+	Strict bool
+	// When true, a field that is not valid UTF-8 is assumed to be
+	// Windows-1252 and converted to UTF-8. Fields that are valid
+	// UTF-8 are left as they are, so the choice is made field by
+	// field.
+	FallbackWindows1252 bool
+	// When true, a field that is not valid UTF-8 makes ReadRow
+	// fail with a *UTF8Error.
+	ValidateUTF8 bool
+	// When non-empty, an unquoted field that appears in the input
+	// exactly as NullString, such as `\N`, is reported as nil by
+	// ReadRowPtr. Escape sequences are matched as written.
+	NullString string
+	// When non-empty, an unquoted empty field is read as
+	// EmptyUnquotedAs, keeping it apart from a quoted empty field
+	// such as `""`. The Writer writes a field equal to
+	// EmptyUnquotedAs as an unquoted empty field, and quotes empty
+	// fields.
+	EmptyUnquotedAs string
+	// When non-empty, ReadRowMap puts the fields of a row past the
+	// end of the header under this key, joined by the field
+	// delimiter. Otherwise such rows make it fail with a
+	// *FieldCountError.
+	ExtraFieldsKey string
+	// How columns of the header that share a name are told apart.
+	// The zero value is DuplicatesKeepFirst.
+	DuplicateHeaders DuplicateHeaders
+	// How names in the header, and names looked up in it, are
+	// normalized before they are compared. Header returns the
+	// names as read.
+	HeaderNormalization HeaderNormalization
+	// When true, rows shorter than FieldsPerRecord, or than the
+	// first row if FieldsPerRecord is not positive, are padded
+	// with empty fields.
+	PadRows bool
+	// When true, fields past FieldsPerRecord, or past the width of
+	// the first row if FieldsPerRecord is not positive, are
+	// dropped. Rows are then never rejected for exceeding
+	// MaxColumns; fields past MaxColumns are not kept, even when
+	// FieldsPerRecord is larger.
+	TruncateRows bool
+	// When positive, the maximum number of bytes in a field, as
+	// read before any trimming. Longer fields make ReadRow fail
+	// with a *FieldSizeError.
+	MaxFieldSize int
+	// When positive, the maximum number of fields in a row. Wider
+	// rows make ReadRow fail with a *ColumnLimitError.
+	MaxColumns int
+	// When positive, the maximum number of bytes of input to read
+	// in total. Needing more makes ReadRow fail with an
+	// *InputSizeError. Rows already returned remain valid.
+	MaxBytes int64
+	// When positive, ReadAll stops after reading MaxRows rows.
+	MaxRows int
+	// Number of fields expected in each row, read or written. If
+	// positive, every row must have exactly that many fields. If
+	// zero, the count is taken from the first row. If negative, no
+	// check is made. DefaultConfig disables the check.
+	FieldsPerRecord int
 }
 
+// When the Writer quotes fields.
+type Quoting int
+
+const (
+	// Quote fields only when needed to read them back.
+	QuoteMinimal Quoting = iota
+	// Quote every field.
+	QuoteAll
+	// Quote every field that is not a decimal number.
+	QuoteNonNumeric
+	// Never quote, failing with a *QuoteError on fields that need it.
+	QuoteNever
+)
+
+// What is done with columns of a header that share a name.
+type DuplicateHeaders int
+
+const (
+	// The first column of a name is used, the others ignored.
+	DuplicatesKeepFirst DuplicateHeaders = iota
+	// The last column of a name is used, the others ignored.
+	DuplicatesKeepLast
+	// The header is rejected with a *DuplicateHeaderError.
+	DuplicatesError
+	// Later columns of a name get a suffix of "_2", "_3" and so on,
+	// skipping names already in the header.
+	DuplicatesSuffix
+)
+
+// Changes made to header names before comparing them, which can be
+// combined with |.
+type HeaderNormalization uint
+
+const (
+	// Letters are made lower case.
+	HeaderFoldCase HeaderNormalization = 1 << iota
+	// Leading and trailing white space is removed.
+	HeaderTrimSpace
+	// Runs of white space become a single space.
+	HeaderCollapseSpace
+	// Everything but letters and digits is removed.
+	HeaderAlphanumeric
+)
+
+// Returns name as changed by n.
+func (n HeaderNormalization) apply(name string) string {
+	if n&HeaderFoldCase != 0 {
+		name = strings.ToLower(name)
+	}
+	if n&HeaderTrimSpace != 0 {
+		name = strings.TrimSpace(name)
+	}
+	if n&HeaderCollapseSpace != 0 {
+		name = strings.Join(strings.Fields(name), " ")
+	}
+	if n&HeaderAlphanumeric != 0 {
+		name = strings.Map(func(c rune) rune {
+			if unicode.IsLetter(c) || unicode.IsDigit(c) {
+				return c
+			}
+			return -1
+		}, name)
+	}
+	return name
+}
+
+// How floats are formatted when writing.
+type FloatFormat struct {
+	// Format and precision as for strconv.FormatFloat. A zero Fmt
+	// means 'g' with the smallest precision that reads back
+	// exactly, whatever Prec is.
+	Fmt  byte
+	Prec int
+	// Written for NaN and infinities. Empty strings stand for
+	// "NaN", "+Inf" and "-Inf".
+	NaN, PosInf, NegInf string
+	// When true, NaN and infinities fail with ErrNonFinite.
+	RejectNonFinite bool
+}
+
+// Formats f, a float of the given bit size.
+func (ff *FloatFormat) format(f float64, bitSize int) (string, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		if ff.RejectNonFinite {
+			return "", ErrNonFinite
+		}
+		s := ff.NaN
+		if f > 0 {
+			s = ff.PosInf
+		} else if f < 0 {
+			s = ff.NegInf
+		}
+		if s != "" {
+			return s, nil
+		}
+	}
+	if ff.Fmt == 0 {
+		return strconv.FormatFloat(f, 'g', -1, bitSize), nil
+	}
+	return strconv.FormatFloat(f, ff.Fmt, ff.Prec, bitSize), nil
+}
+
+// Strings that bools are written as.
+type BoolFormat struct {
+	True, False string
+}
+
+// Common ways to write bools.
+var (
+	BoolTrueFalse = BoolFormat{"true", "false"}
+	BoolUpper     = BoolFormat{"TRUE", "FALSE"}
+	BoolOneZero   = BoolFormat{"1", "0"}
+	BoolYN        = BoolFormat{"Y", "N"}
+)
+
+func (bf *BoolFormat) format(b bool) string {
+	if *bf == (BoolFormat{}) {
+		return strconv.FormatBool(b)
+	}
+	if b {
+		return bf.True
+	}
+	return bf.False
+}
+
+// Parses s as a bool written in bf or any of the common ways,
+// ignoring case.
+func (bf *BoolFormat) parse(s string) (bool, error) {
+	for _, f := range []BoolFormat{*bf, BoolTrueFalse, BoolOneZero, BoolYN} {
+		if f == (BoolFormat{}) {
+			continue
+		}
+		if strings.EqualFold(s, f.True) {
+			return true, nil
+		}
+		if strings.EqualFold(s, f.False) {
+			return false, nil
+		}
+	}
+	return false, strconv.ErrSyntax
+}
+
+// Returned when writing a NaN or infinite float with
+// FloatFormat.RejectNonFinite set.
+var ErrNonFinite = errors.New("float is NaN or infinite")
+
+// Returned when a quoted field contains a quote that is neither
+// doubled nor followed by a delimiter or end of line.
+var ErrQuote = errors.New("extraneous or missing quote in quoted field")
+
+// Returned when the input ends with an unfinished escape sequence.
+var ErrTrailingEscape = errors.New("escape character at end of input")
+
+// Returned in strict mode when a quote appears in an unquoted field.
+var ErrBareQuote = errors.New("bare quote in non-quoted field")
+
+// Returned in strict mode when a row ends with a lone '\r'.
+var ErrBareCR = errors.New("carriage return not followed by newline")
+
+// Returned with DisallowQuotedNewlines set when a quoted field
+// contains a line break.
+var ErrQuotedNewline = errors.New("line break in quoted field")
+
+// Describes a syntax error in the input and where it was found.
+type ParseError struct {
+	Line   int // 1-based line of the error
+	Column int // 1-based byte offset of the error within the line
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %v", e.Line, e.Column, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Returned by ReadRow when a row does not have the expected
+// number of fields.
+type FieldCountError struct {
+	Row      int // 1-based index of the offending row
+	Expected int
+	Actual   int
+}
+
+func (e *FieldCountError) Error() string {
+	return fmt.Sprintf("row %d: expected %d fields, got %d", e.Row, e.Expected, e.Actual)
+}
+
+// Returned by ReadRow when a field is longer than MaxFieldSize.
+type FieldSizeError struct {
+	Row   int // 1-based index of the offending row
+	Field int // 0-based index of the field within the row
+	Limit int
+}
+
+func (e *FieldSizeError) Error() string {
+	return fmt.Sprintf("row %d, field %d: field exceeds %d bytes", e.Row, e.Field, e.Limit)
+}
+
+// Returned by ReadRow with ValidateUTF8 set when a field is not
+// valid UTF-8.
+type UTF8Error struct {
+	Row    int // 1-based index of the offending row
+	Field  int // 0-based index of the field within the row
+	Offset int // offset of the first invalid byte within the field
+}
+
+func (e *UTF8Error) Error() string {
+	return fmt.Sprintf("row %d, field %d: invalid UTF-8 at byte %d", e.Row, e.Field, e.Offset)
+}
+
+// Returns the offset of the first invalid UTF-8 byte in s.
+func invalidUTF8(s string) int {
+	for i := 0; i < len(s); {
+		c, n := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && n == 1 {
+			return i
+		}
+		i += n
+	}
+	return -1
+}
+
+// Matched by errors.Is for any *InputSizeError.
+var ErrInputTooLarge = errors.New("input too large")
+
+// Returned by ReadRow once MaxBytes bytes of input have been read
+// and more are needed.
+type InputSizeError struct {
+	Limit    int64
+	Consumed int64
+}
+
+func (e *InputSizeError) Error() string {
+	return fmt.Sprintf("input too large: read %d bytes of %d allowed", e.Consumed, e.Limit)
+}
+
+func (e *InputSizeError) Is(target error) bool {
+	return target == ErrInputTooLarge
+}
+
+// Returned by WriteRow with Quoting set to QuoteNever when a field
+// would need quoting.
+type QuoteError struct {
+	Row   int // 1-based index of the offending row
+	Field int // 0-based index of the field within the row
+	Value string
+}
+
+func (e *QuoteError) Error() string {
+	return fmt.Sprintf("row %d, field %d: %q needs quoting", e.Row, e.Field, e.Value)
+}
+
+// Returned by WriteHeader when a header has already been written.
+var ErrHeaderWritten = errors.New("header already written")
+
+// Returned by WriteHeader when rows have already been written.
+var ErrHeaderAfterRows = errors.New("header written after rows")
+
+// Returned when writing to a Writer after Close.
+var ErrWriterClosed = errors.New("writer closed")
+
+// Returned when BeginRow, EndRow and the calls between them are
+// made out of order.
+var ErrRowOrder = errors.New("row begun or ended out of order")
+
+// Returned by WriteRowMap, and by Reader methods that need a header,
+// when no header has been set.
+var ErrNoHeader = errors.New("no header set")
+
+// Returned by WriteRowMap with RejectUnknownKeys set when a map has
+// a key that is not in the header.
+type UnknownKeyError struct {
+	Row int // 1-based index of the offending row
+	Key string
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("row %d: unknown key %q", e.Row, e.Key)
+}
+
+// Returned by ReadHeader with DuplicateHeaders set to DuplicatesError
+// when columns share a name.
+type DuplicateHeaderError struct {
+	Name      string
+	Positions []int // 0-based positions of the columns
+}
+
+func (e *DuplicateHeaderError) Error() string {
+	return fmt.Sprintf("duplicate column %q at positions %v", e.Name, e.Positions)
+}
+
+// Returned by SelectColumns for a name that is not in the header.
+type UnknownColumnError struct {
+	Name string
+}
+
+func (e *UnknownColumnError) Error() string {
+	return fmt.Sprintf("unknown column %q", e.Name)
+}
+
+// Returned by ExpectHeader when the header is not as expected. Names
+// of required columns are as given to ExpectHeader, those of extra
+// columns as read.
+type HeaderError struct {
+	Missing    []string // required columns not in the header
+	Extra      []string // columns in the header that are not required
+	OutOfOrder []string // required columns not where the order puts them
+}
+
+func (e *HeaderError) Error() string {
+	var parts []string
+	for _, p := range []struct {
+		what  string
+		names []string
+	}{{"missing", e.Missing}, {"unexpected", e.Extra}, {"out of order", e.OutOfOrder}} {
+		if len(p.names) > 0 {
+			parts = append(parts, p.what+" "+strings.Join(p.names, ", "))
+		}
+	}
+	return "header mismatch: " + strings.Join(parts, "; ")
+}
+
+// Relaxes the checks made by ExpectHeader.
+type HeaderOption int
+
+const (
+	// Columns that are not required are allowed.
+	AllowExtraColumns HeaderOption = iota + 1
+	// Required columns may come in any order.
+	IgnoreColumnOrder
+)
+
+// Returned by ReadRow when a row has more than MaxColumns fields.
+type ColumnLimitError struct {
+	Row   int // 1-based index of the offending row
+	Limit int
+}
+
+func (e *ColumnLimitError) Error() string {
+	return fmt.Sprintf("row %d: more than %d fields", e.Row, e.Limit)
+}
+
+// Internal signal from parseCell, turned into a *FieldSizeError.
+var errFieldTooLong = errors.New("field too long")
+
 // The default config. Most CSV should use this.
 // Based on RFC 4180 (http://http://tools.ietf.org/html/rfc4180).
 func DefaultConfig() Config {
-	return Config{TrimSpaces: false, FieldDelim: ','}
+	return Config{TrimSpaces: false, FieldDelim: ',', QuoteChar: '"', FieldsPerRecord: -1, RecordDelim: '\n'}
+}
+
+// Describes a Config setting that cannot be used.
+type ConfigError struct {
+	Field  string // name of the offending Config field
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid Config." + e.Field + ": " + e.Reason
+}
+
+// Reports a *ConfigError if the Config is unusable. Readers and
+// Writers validate their Config before first use.
+func (c *Config) Validate() error {
+	d, field := c.delim(), "FieldDelim"
+	if c.FieldDelimString != "" {
+		field = "FieldDelimString"
+	} else if c.FieldDelimRune != 0 {
+		field = "FieldDelimRune"
+		if !utf8.ValidRune(c.FieldDelimRune) {
+			return &ConfigError{field, "not a valid rune"}
+		}
+	}
+	q := c.quote()
+	switch {
+	case d == "\x00":
+		return &ConfigError{field, "must not be zero"}
+	case strings.ContainsAny(d, "\r\n"):
+		return &ConfigError{field, "must not contain \\r or \\n"}
+	case strings.IndexByte(d, q) >= 0:
+		return &ConfigError{field, "must not contain QuoteChar"}
+	case strings.IndexByte(d, c.recordDelim()) >= 0:
+		return &ConfigError{field, "must not contain RecordDelim"}
+	case c.RecordDelimOut != "" && (strings.IndexByte(c.RecordDelimOut, q) >= 0 ||
+		strings.Contains(c.RecordDelimOut, d) || strings.Contains(d, c.RecordDelimOut)):
+		return &ConfigError{"RecordDelimOut", "must not contain QuoteChar or overlap " + field}
+	case q == '\r' || q == '\n' || q == c.recordDelim():
+		return &ConfigError{"QuoteChar", "must not be \\r, \\n or RecordDelim"}
+	case c.Comment != 0 && (strings.IndexByte(d, c.Comment) >= 0 || c.Comment == q):
+		return &ConfigError{"Comment", "must differ from " + field + " and QuoteChar"}
+	case c.InlineComment != 0 && (strings.IndexByte(d, c.InlineComment) >= 0 || c.InlineComment == q):
+		return &ConfigError{"InlineComment", "must differ from " + field + " and QuoteChar"}
+	case c.Escape != 0 && (strings.IndexByte(d, c.Escape) >= 0 || c.Escape == q):
+		return &ConfigError{"Escape", "must differ from " + field + " and QuoteChar"}
+	case c.EscapeNewlines && c.Escape == '\\':
+		return &ConfigError{"EscapeNewlines", "cannot be combined with Escape '\\'"}
+	case c.PreferEscape && c.Escape == 0:
+		return &ConfigError{"PreferEscape", "requires Escape"}
+	case c.LazyQuotes && c.Strict:
+		return &ConfigError{"LazyQuotes", "cannot be combined with Strict"}
+	case c.FloatFormat.Fmt != 0 && strings.IndexByte("beEfgGxX", c.FloatFormat.Fmt) < 0:
+		return &ConfigError{"FloatFormat", "unknown Fmt"}
+	case c.Quoting < QuoteMinimal || c.Quoting > QuoteNever:
+		return &ConfigError{"Quoting", "unknown mode"}
+	case c.DuplicateHeaders < DuplicatesKeepFirst || c.DuplicateHeaders > DuplicatesSuffix:
+		return &ConfigError{"DuplicateHeaders", "unknown policy"}
+	}
+	return nil
+}
+
+// The field delimiter as it appears in the output.
+func (c *Config) delim() string {
+	if c.FieldDelimString != "" {
+		return c.FieldDelimString
+	}
+	if c.FieldDelimRune != 0 {
+		return string(c.FieldDelimRune)
+	}
+	return string([]byte{c.FieldDelim})
+}
+
+// The runes trimmed from unquoted fields.
+func (c *Config) cutset() string {
+	if c.TrimCutset != "" {
+		return c.TrimCutset
+	}
+	if c.TrimSpaces {
+		return " "
+	}
+	return ""
+}
+
+func (c *Config) recordDelim() byte {
+	if c.RecordDelimNUL {
+		return 0
+	}
+	if c.RecordDelim == 0 {
+		return '\n'
+	}
+	return c.RecordDelim
+}
+
+func (c *Config) quote() byte {
+	if c.QuoteChar == 0 {
+		return '"'
+	}
+	return c.QuoteChar
+}
+
+type Reader struct {
+	tmpbuf  bytes.Buffer
+	br      io.ByteReader
+	buf     *bufio.Reader // wraps sources that are not buffered
+	closer  io.Closer     // the source, if it can be closed
+	pending []byte
+	rows    int // number of rows returned so far
+	fields  int // expected fields per row, once known
+	started bool
+	footer  []string
+	header  []string // as read by ReadHeader
+	// position of the column each name stands for, as decided by
+	// Config.DuplicateHeaders
+	headerIndex map[string]int
+	// columns ReadRow returns, in order, as set by SelectColumns
+	selected    []int
+	wanted      []bool // whether each column is selected
+	pickedMarks []cellMark
+	// called with fields discarded by TruncateRows
+	onTruncate func(row int, tail []string)
+	filter     func(row []string) bool
+	// Config as it was before a sep= directive changed it.
+	beforeSep *Config
+	cell      cellMark   // marks of the last cell parsed
+	marks     []cellMark // marks of each field of the last row, if kept
+	wantMarks bool
+	skipping  bool         // fields are being parsed only to be discarded
+	consumed  int64        // bytes taken from br
+	check     ReadPosition // position after the last complete row
+	// Position of the next byte to be read.
+	offset        int64
+	line          int // number of line breaks before offset
+	lineStart     int64
+	prevLineStart int64
+	Config        Config
+}
+
+// Creates a reader with the default Config. r is wrapped in a
+// bufio.Reader unless it is already buffered.
+func NewReader(r io.Reader) *Reader {
+	p := &Reader{Config: DefaultConfig()}
+	p.setSource(r)
+	return p
+}
+
+// Creates a reader with the default Config that calls br.ReadByte
+// directly, for callers that bring their own buffering.
+func NewUnbufferedReader(br io.ByteReader) *Reader {
+	closer, _ := br.(io.Closer)
+	return &Reader{br: br, closer: closer, Config: DefaultConfig()}
+}
+
+// Closes the source of input if it implements io.Closer. Later
+// calls do nothing.
+func (r *Reader) Close() error {
+	c := r.closer
+	r.closer = nil
+	if c == nil {
+		return nil
+	}
+	return c.Close()
+}
+
+// Creates a reader with the given Config, or returns a *ConfigError
+// if the Config is invalid. r is wrapped as by NewReader.
+func NewReaderConfig(r io.Reader, config Config) (*Reader, error) {
+	if e := config.Validate(); e != nil {
+		return nil, e
+	}
+	p := &Reader{Config: config}
+	p.setSource(r)
+	return p, nil
+}
+
+// Makes src the source of input, wrapping it in the Reader's own
+// bufio.Reader unless it is a type known to have a cheap ReadByte.
+func (r *Reader) setSource(src io.Reader) {
+	r.closer, _ = src.(io.Closer)
+	switch br := src.(type) {
+	case *bufio.Reader, *bytes.Buffer, *bytes.Reader, *strings.Reader:
+		r.br = br.(io.ByteReader)
+	default:
+		if r.buf == nil {
+			r.buf = bufio.NewReader(src)
+		} else {
+			r.buf.Reset(src)
+		}
+		r.br = r.buf
+	}
+}
+
+// Discards all state and makes r read from src, keeping its Config
+// and buffers, and the functions set by SetRowFilter and
+// SetTruncateFunc. A delimiter set by a sep= directive is reverted.
+func (r *Reader) Reset(src io.Reader) {
+	config := r.Config
+	if r.beforeSep != nil {
+		config.FieldDelim = r.beforeSep.FieldDelim
+		config.FieldDelimRune = r.beforeSep.FieldDelimRune
+		config.FieldDelimString = r.beforeSep.FieldDelimString
+	}
+	*r = Reader{
+		tmpbuf:  *bytes.NewBuffer(r.tmpbuf.Bytes()[:0]),
+		buf:     r.buf,
+		pending: r.pending[:0],
+		marks:   r.marks[:0],
+		Config:  config,
+
+		onTruncate: r.onTruncate,
+		filter:     r.filter,
+	}
+	r.setSource(src)
+}
+
+// A point in the input just past a row, from which Resume can carry
+// on reading.
+type ReadPosition struct {
+	Offset int64 // bytes of input before the point
+	Rows   int   // rows read before the point
+	Lines  int   // line breaks before the point
+	Delim  rune  // field delimiter set by a sep= directive, or 0
+}
+
+// Records the current position as the last checkpoint.
+func (r *Reader) checkpoint() {
+	r.check = ReadPosition{Offset: r.offset, Rows: r.rows, Lines: r.line}
+	if r.beforeSep != nil {
+		r.check.Delim = rune(r.Config.FieldDelim)
+		if r.Config.FieldDelimRune != 0 {
+			r.check.Delim = r.Config.FieldDelimRune
+		}
+	}
+}
+
+// Returns the offset in the input just past the last row read, and
+// the number of rows read up to that point. Offsets are not
+// meaningful for input decoded from UTF-16.
+func (r *Reader) Checkpoint() (offset int64, rowsRead int) {
+	return r.check.Offset, r.check.Rows
+}
+
+// Returns the position just past the last row read, like
+// Checkpoint, along with the rest of what Resume needs to carry on
+// from it.
+func (r *Reader) Position() ReadPosition {
+	return r.check
+}
+
+// Like Reset, but seeks rs to pos.Offset and carries on from a
+// position returned by Position. Row and line numbers carry on from
+// pos, and a delimiter set by a sep= directive before pos is used
+// again. A byte order mark, sep= directive and SkipLines are only
+// handled when pos.Offset is 0. The field count taken from the first
+// row when FieldsPerRecord is 0 is taken again from the first row
+// read.
+func (r *Reader) Resume(rs io.ReadSeeker, pos ReadPosition) error {
+	if _, e := rs.Seek(pos.Offset, io.SeekStart); e != nil {
+		return e
+	}
+	r.Reset(rs)
+	if d := pos.Delim; d != 0 {
+		r.setSepDelim(d)
+	}
+	if pos.Offset > 0 {
+		if e := r.Config.Validate(); e != nil {
+			return e
+		}
+		r.started = true
+	}
+	offset := pos.Offset
+	r.offset, r.consumed, r.lineStart, r.prevLineStart = offset, offset, offset, offset
+	r.rows, r.line, r.check = pos.Rows, pos.Lines, pos
+	return nil
+}
+
+// Reads the next byte, taking any pushed back bytes first.
+func (r *Reader) readByte() (byte, error) {
+	if n := len(r.pending); n > 0 {
+		b := r.pending[n-1]
+		r.pending = r.pending[:n-1]
+		r.advance(b)
+		return b, nil
+	}
+	max := r.Config.MaxBytes
+	if max > 0 && r.consumed > max {
+		return 0, &InputSizeError{Limit: max, Consumed: r.consumed}
+	}
+	b, e := r.br.ReadByte()
+	if e == nil {
+		r.consumed += 1
+		if max > 0 && r.consumed > max {
+			return 0, &InputSizeError{Limit: max, Consumed: r.consumed}
+		}
+		r.advance(b)
+	}
+	return b, e
+}
+
+// Accounts for b having been read.
+func (r *Reader) advance(b byte) {
+	r.offset += 1
+	if b == '\n' {
+		r.line += 1
+		r.prevLineStart = r.lineStart
+		r.lineStart = r.offset
+	}
+}
+
+// Pushes b back so that the next readByte returns it.
+func (r *Reader) unreadByte(b byte) {
+	r.pending = append(r.pending, b)
+	r.offset -= 1
+	if b == '\n' {
+		r.line -= 1
+		r.lineStart = r.prevLineStart
+	}
+}
+
+// Wraps e with the position of the last byte read.
+func (r *Reader) syntaxError(e error) error {
+	line, col := r.line+1, int(r.offset-r.lineStart)
+	if col == 0 && r.line > 0 {
+		// the last byte read ended a line
+		line, col = r.line, int(r.lineStart-r.prevLineStart)
+	}
+	return &ParseError{Line: line, Column: col, Err: e}
+}
+
+// Consumes any comment lines, and blank lines when SkipBlankLines
+// is set, ahead of the next row.
+func (r *Reader) skipLines() error {
+	for {
+		spaces := 0
+		b, e := r.readByte()
+		for b == ' ' && e == nil {
+			spaces += 1
+			b, e = r.readByte()
+		}
+		skip := false
+		if e == nil && r.Config.Comment != 0 && b == r.Config.Comment {
+			for e == nil && !skip {
+				b, e = r.readByte()
+				if e == nil {
+					skip, e = r.atRecordEnd(b)
+				}
+			}
+			if e == io.EOF {
+				return nil
+			}
+		} else if e == nil && r.Config.SkipBlankLines && (spaces == 0 || r.Config.TrimSpaces) {
+			skip, e = r.atRecordEnd(b)
+			if !skip && e == nil {
+				r.unreadByte(b)
+			}
+		} else if e == nil {
+			r.unreadByte(b)
+		}
+		if skip {
+			continue
+		}
+		if e != nil && e != io.EOF {
+			return e
+		}
+		for ; spaces > 0; spaces-- {
+			r.unreadByte(' ')
+		}
+		return nil
+	}
+}
+
+// Ways a cell can end, as reported by parseCell.
+const (
+	endOfInput = iota
+	endOfField
+	endOfRecord
+)
+
+// Reports whether b, the byte just read, starts the field delimiter.
+// The remaining bytes of a multi-byte delimiter are consumed on a
+// match and pushed back otherwise.
+func (r *Reader) atDelim(b byte) (bool, error) {
+	if d := r.Config.FieldDelimString; d != "" {
+		return r.match(b, d)
+	}
+	d := r.Config.FieldDelimRune
+	if d == 0 {
+		return b == r.Config.FieldDelim, nil
+	}
+	if d < utf8.RuneSelf {
+		return b == byte(d), nil
+	}
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], d)
+	if b != buf[0] {
+		return false, nil
+	}
+	return r.match(b, string(buf[:n]))
+}
+
+// Reports whether b followed by the next bytes of input equals s.
+// The bytes after b are consumed on a match and pushed back otherwise.
+func (r *Reader) match(b byte, s string) (bool, error) {
+	if b != s[0] {
+		return false, nil
+	}
+	for i := 1; i < len(s); i++ {
+		c, e := r.readByte()
+		if e != nil && e != io.EOF {
+			return false, e
+		}
+		if e != nil || c != s[i] {
+			if e == nil {
+				r.unreadByte(c)
+			}
+			for j := i - 1; j > 0; j-- {
+				r.unreadByte(s[j])
+			}
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Reports whether b, the byte just read (with e its error), ends
+// the current cell, and if so how.
+func (r *Reader) cellEnd(b byte, e error) (end int, ok bool, err error) {
+	if e != nil {
+		if e == io.EOF {
+			return endOfInput, true, nil
+		}
+		return endOfInput, false, e
+	}
+	if b == r.Config.InlineComment && b != 0 {
+		// the rest of the line is a comment
+		for {
+			if b, e = r.readByte(); e != nil {
+				if e == io.EOF {
+					return endOfInput, true, nil
+				}
+				return endOfInput, false, e
+			}
+			if ok, err = r.atRecordEnd(b); ok || err != nil {
+				return endOfRecord, ok, err
+			}
+		}
+	}
+	if ok, err = r.atRecordEnd(b); ok || err != nil {
+		return endOfRecord, ok, err
+	}
+	ok, err = r.atDelim(b)
+	return endOfField, ok, err
+}
+
+// Reports whether b, the byte just read, ends a row.
+func (r *Reader) atRecordEnd(b byte) (bool, error) {
+	rd := r.Config.recordDelim()
+	if b == rd {
+		return true, nil
+	}
+	if b == '\r' && rd == '\n' {
+		// Line endings may be '\r\n' or a lone '\r'.
+		c, e := r.readByte()
+		if e != nil && e != io.EOF {
+			return false, e
+		}
+		if e == nil && c == '\n' {
+			return true, nil
+		}
+		if e == nil {
+			r.unreadByte(c)
+		}
+		if r.Config.Strict {
+			return false, r.syntaxError(ErrBareCR)
+		}
+		r.line += 1
+		r.prevLineStart = r.lineStart
+		r.lineStart = r.offset
+		return true, nil
+	}
+	return false, nil
+}
+
+// Reads the byte following an escape byte and returns the
+// literal byte it stands for.
+func (r *Reader) readEscaped() (byte, error) {
+	b, e := r.readByte()
+	if e != nil {
+		if e == io.EOF {
+			e = r.syntaxError(ErrTrailingEscape)
+		}
+		return 0, e
+	}
+	return b, nil
+}
+
+// Write and read line breaks and backslashes for EscapeNewlines.
+var (
+	newlineEscaper   = strings.NewReplacer(`\`, `\\`, "\r\n", `\n`, "\n", `\n`, "\r", `\r`)
+	newlineUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r")
+)
+
+// Returns the literal byte that b stands for after an escape byte.
+func unescape(b byte) byte {
+	switch b {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	}
+	return b
+}
+
+// Advances a match of the raw bytes of an unquoted field against
+// null, where n bytes of null have matched so far and b is the next
+// raw byte. Returns -1 once the field can no longer match. Bytes in
+// cutset after a full match are allowed as they will be trimmed.
+func matchNull(null string, n int, b byte, cutset string) int {
+	switch {
+	case n < 0:
+		return n
+	case n < len(null) && null[n] == b:
+		return n + 1
+	case n == len(null) && strings.IndexByte(cutset, b) >= 0:
+		return n
+	}
+	return -1
+}
+
+// Returns the contents of the quoted field in tmpbuf.
+func (r *Reader) quotedValue() string {
+	if !r.Config.TrimQuoted {
+		return r.tmpbuf.String()
+	}
+	if r.Config.TrimCutset != "" {
+		return string(bytes.Trim(r.tmpbuf.Bytes(), r.Config.TrimCutset))
+	}
+	return string(bytes.TrimSpace(r.tmpbuf.Bytes()))
+}
+
+// Reports whether the field in tmpbuf has outgrown MaxFieldSize.
+func (r *Reader) fieldTooLong() bool {
+	return r.Config.MaxFieldSize > 0 && r.tmpbuf.Len() > r.Config.MaxFieldSize
+}
+
+func (r *Reader) parseQuoted() (string, int, error) {
+	r.cell.quoted = true
+	q := r.Config.quote()
+	r.tmpbuf.Reset()
+	for {
+		if r.fieldTooLong() {
+			return "", endOfInput, errFieldTooLong
+		}
+		b, e := r.readByte()
+		if e != nil {
+			if e == io.EOF {
+				if r.Config.LazyQuotes {
+					return r.quotedValue(), endOfInput, nil
+				}
+				e = io.ErrUnexpectedEOF
+			}
+			return "", endOfInput, e
+		}
+
+		if b == r.Config.Escape && b != 0 {
+			if b, e = r.readEscaped(); e != nil {
+				return "", endOfInput, e
+			}
+			r.tmpbuf.WriteByte(unescape(b))
+			continue
+		}
+		if (b == '\n' || b == '\r') && r.Config.DisallowQuotedNewlines {
+			return "", endOfInput, r.syntaxError(ErrQuotedNewline)
+		}
+		if b == '\r' && r.Config.NormalizeQuotedNewlines {
+			if c, e := r.readByte(); e == nil && c != '\n' {
+				r.unreadByte(c)
+			}
+			b = '\n'
+		}
+		if b != q {
+			// anything not a quote is just copied over
+			r.tmpbuf.WriteByte(b)
+			continue
+		}
+		b, e = r.readByte()
+		if b == q && e == nil {
+			// if we got two quotes, parse as one
+			r.tmpbuf.WriteByte(q)
+			continue
+		}
+		// eat trailing whitespace, unless it is a delimiter
+		spaces := 0
+		for b == ' ' && e == nil && !r.Config.Strict && r.Config.delim()[0] != ' ' {
+			spaces += 1
+			b, e = r.readByte()
+		}
+		end, ok, e := r.cellEnd(b, e)
+		if e != nil {
+			return "", end, e
+		}
+		if ok {
+			if r.skipping {
+				return "", end, nil
+			}
+			return r.quotedValue(), end, nil
+		}
+		if !r.Config.LazyQuotes || r.Config.Strict {
+			return "", end, r.syntaxError(ErrQuote)
+		}
+		// a bare quote inside a quoted field is kept as-is
+		r.tmpbuf.WriteByte(q)
+		for ; spaces > 0; spaces-- {
+			r.tmpbuf.WriteByte(' ')
+		}
+		r.unreadByte(b)
+	}
+}
+
+// Consumes leading runes found in cutset and returns the first byte
+// after them.
+func (r *Reader) trimLeft(cutset string) (byte, error) {
+	var buf [utf8.UTFMax]byte
+	for {
+		b, e := r.readByte()
+		if e != nil {
+			return b, e
+		}
+		// the delimiter is never trimmed, even if in cutset
+		if d := r.Config.delim(); b == d[0] {
+			ok, e := r.atDelim(b)
+			if e != nil {
+				return 0, e
+			}
+			if ok {
+				for i := len(d) - 1; i > 0; i-- {
+					r.unreadByte(d[i])
+				}
+				return b, nil
+			}
+		}
+		if b < utf8.RuneSelf {
+			if strings.IndexByte(cutset, b) < 0 || b == r.Config.recordDelim() || b == '\r' {
+				return b, nil
+			}
+			continue
+		}
+		buf[0] = b
+		n := 1
+		for ; n < len(buf) && !utf8.FullRune(buf[:n]); n++ {
+			if buf[n], e = r.readByte(); e != nil {
+				break
+			}
+		}
+		if e != nil && e != io.EOF {
+			return 0, e
+		}
+		if c, _ := utf8.DecodeRune(buf[:n]); c == utf8.RuneError || !strings.ContainsRune(cutset, c) {
+			for n--; n > 0; n-- {
+				r.unreadByte(buf[n])
+			}
+			return b, nil
+		}
+	}
+}
+
+func (r *Reader) parseCell() (string, int, error) {
+	r.tmpbuf.Reset()
+	r.cell = cellMark{}
+	cutset := r.Config.cutset()
+	var b byte
+	var e error
+	if cutset != "" {
+		// eat leading whitespace
+		b, e = r.trimLeft(cutset)
+	} else {
+		b, e = r.readByte()
+	}
+	if e == io.EOF {
+		return "", endOfInput, e
+	}
+	if b == r.Config.quote() && e == nil {
+		return r.parseQuoted()
+	}
+	// escaped bytes up to keep are never trimmed
+	keep := 0
+	null, nulled := r.Config.NullString, 0
+	for {
+		if r.fieldTooLong() {
+			return "", endOfInput, errFieldTooLong
+		}
+		if e == nil && b == r.Config.Escape && b != 0 {
+			c, err := r.readEscaped()
+			if err != nil {
+				return "", endOfInput, err
+			}
+			if null != "" {
+				nulled = matchNull(null, matchNull(null, nulled, b, ""), c, "")
+			}
+			r.tmpbuf.WriteByte(unescape(c))
+			keep = r.tmpbuf.Len()
+			b, e = r.readByte()
+			continue
+		}
+		end, ok, err := r.cellEnd(b, e)
+		if err != nil {
+			return "", end, err
+		}
+		if !ok && b == r.Config.quote() && r.Config.Strict {
+			return "", end, r.syntaxError(ErrBareQuote)
+		}
+		if ok && r.skipping {
+			return "", end, nil
+		}
+		if ok {
+			s := r.tmpbuf.Bytes()
+			if cutset != "" {
+				s = s[:keep+len(bytes.TrimRight(s[keep:], cutset))]
+			}
+			r.cell.null = null != "" && nulled == len(null)
+			return string(s), end, nil
+		}
+		if null != "" {
+			nulled = matchNull(null, nulled, b, cutset)
+		}
+		r.tmpbuf.WriteByte(b)
+		b, e = r.readByte()
+	}
+}
+
+// Reads a single row into a []string.
+func (r *Reader) ReadRow() ([]string, error) {
+	row, e := r.readFull()
+	if row != nil && r.selected != nil {
+		var pe error
+		if row, pe = r.project(row); pe != nil {
+			return nil, pe
+		}
+	}
+	return row, e
+}
+
+// Reads the next row that passes the filter, with all its columns.
+func (r *Reader) readFull() ([]string, error) {
+	for {
+		row, e := r.nextRow()
+		if row != nil && e == nil {
+			r.checkpoint()
+		}
+		if row == nil || r.filter == nil || r.filter(row) {
+			return row, e
+		}
+	}
+}
+
+// Sets a predicate that rows must satisfy to be returned by ReadRow.
+// It is given each row after trimming and padding. Rows it rejects
+// are skipped but still counted in row numbers. A nil f accepts all
+// rows.
+func (r *Reader) SetRowFilter(f func(row []string) bool) {
+	r.filter = f
+}
+
+// Reads the next row, checked against the Config.
+func (r *Reader) nextRow() ([]string, error) {
+	if r.footer != nil {
+		return nil, io.EOF
+	}
+	row, e := r.readRow()
+	if row == nil || (e != nil && e != io.EOF) {
+		return row, e
+	}
+	if p := r.Config.StopAtPrefix; p != "" && strings.HasPrefix(row[0], p) {
+		r.footer = row
+		return nil, io.EOF
+	}
+	r.rows += 1
+	if r.checkFields() {
+		if r.fields == 0 {
+			r.fields = r.Config.FieldsPerRecord
+			if r.fields <= 0 {
+				r.fields = len(row)
+			}
+			if m := r.Config.MaxColumns; r.Config.TruncateRows && m > 0 {
+				r.fields = min(r.fields, m)
+			}
+		}
+		for r.Config.PadRows && len(row) < r.fields {
+			row = append(row, "")
+			r.mark(cellMark{})
+		}
+		if r.Config.TruncateRows && len(row) > r.fields {
+			if r.onTruncate != nil {
+				r.onTruncate(r.rows, row[r.fields:])
+			}
+			row = row[:r.fields:r.fields]
+			r.marks = r.marks[:min(len(r.marks), r.fields)]
+		}
+		if len(row) != r.fields {
+			return nil, &FieldCountError{r.rows, r.fields, len(row)}
+		}
+	}
+	return row, e
+}
+
+// Reports whether rows must be read whole even when columns are
+// selected, because StopAtPrefix, ExtraFieldsKey, a row filter or a
+// truncate function sees the fields before they are picked.
+func (r *Reader) keepsAll() bool {
+	c := &r.Config
+	return c.StopAtPrefix != "" || c.ExtraFieldsKey != "" || r.filter != nil || r.onTruncate != nil
+}
+
+// Reports whether rows are checked against an expected field count.
+func (r *Reader) checkFields() bool {
+	c := &r.Config
+	return c.FieldsPerRecord >= 0 || c.Strict || c.PadRows || c.TruncateRows
+}
+
+// Sets a function to be called with the 1-based row number and the
+// discarded fields whenever TruncateRows shortens a row.
+func (r *Reader) SetTruncateFunc(f func(row int, tail []string)) {
+	r.onTruncate = f
+}
+
+// Returns the row that stopped reading because of StopAtPrefix, or
+// nil if no such row has been read.
+func (r *Reader) Footer() []string {
+	return r.footer
+}
+
+// Consumes a byte order mark at the very start of the input. Input
+// starting with a UTF-16 byte order mark is decoded from UTF-16.
+func (r *Reader) skipBOM() error {
+	b, e := r.readByte()
+	if e != nil {
+		if e == io.EOF {
+			return nil
+		}
+		return e
+	}
+	for _, bom := range []string{"\xEF\xBB\xBF", "\xFF\xFE", "\xFE\xFF"} {
+		ok, e := r.match(b, bom)
+		if e != nil {
+			return e
+		}
+		if ok {
+			if bom != "\xEF\xBB\xBF" {
+				// UTF-16 is decoded to UTF-8 before parsing
+				r.br = &utf16Reader{br: r.br, bigEndian: bom == "\xFE\xFF"}
+			}
+			return nil
+		}
+	}
+	r.unreadByte(b)
+	return nil
+}
+
+// A field along with how it appeared in the input.
+type Cell struct {
+	Value  string
+	Quoted bool // the field was enclosed in quotes
+	Null   bool // the field matched Config.NullString
+}
+
+// How a field appeared in the input.
+type cellMark struct {
+	quoted, null bool
+}
+
+// Records m for the field just read, if marks are being kept.
+func (r *Reader) mark(m cellMark) {
+	if r.wantMarks || r.Config.NullString != "" {
+		r.marks = append(r.marks, m)
+	}
+}
+
+// Reads a single row like ReadRow, describing each field as a Cell.
+func (r *Reader) ReadRowMeta() ([]Cell, error) {
+	r.wantMarks = true
+	row, e := r.ReadRow()
+	r.wantMarks = false
+	if row == nil {
+		return nil, e
+	}
+	cells := make([]Cell, len(row))
+	for i, v := range row {
+		cells[i].Value = v
+		if i < len(r.marks) {
+			cells[i].Quoted, cells[i].Null = r.marks[i].quoted, r.marks[i].null
+		}
+	}
+	return cells, e
+}
+
+// Reads a single row like ReadRow, but with unquoted fields equal
+// to Config.NullString reported as nil.
+func (r *Reader) ReadRowPtr() ([]*string, error) {
+	row, e := r.ReadRow()
+	if row == nil {
+		return nil, e
+	}
+	ptrs := make([]*string, len(row))
+	for i := range row {
+		if i >= len(r.marks) || !r.marks[i].null {
+			ptrs[i] = &row[i]
+		}
+	}
+	return ptrs, e
+}
+
+// Reads the next row as the header, recording it for ReadRowMap.
+// Once a header has been read, it is returned again without reading.
+func (r *Reader) ReadHeader() ([]string, error) {
+	if r.header != nil {
+		return r.header, nil
+	}
+	row, e := r.ReadRow()
+	if e != nil {
+		return nil, e
+	}
+	index, e := r.indexHeader(row)
+	if e != nil {
+		return nil, e
+	}
+	r.header, r.headerIndex = row, index
+	return row, nil
+}
+
+// Maps the normalized names in header to their columns, as decided
+// by Config.DuplicateHeaders.
+func (r *Reader) indexHeader(header []string) (map[string]int, error) {
+	if n := r.Config.HeaderNormalization; n != 0 {
+		names := make([]string, len(header))
+		for i, name := range header {
+			names[i] = n.apply(name)
+		}
+		header = names
+	}
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		_, seen := index[name]
+		switch {
+		case !seen || r.Config.DuplicateHeaders == DuplicatesKeepLast:
+			index[name] = i
+		case r.Config.DuplicateHeaders == DuplicatesError:
+			var at []int
+			for j, n := range header {
+				if n == name {
+					at = append(at, j)
+				}
+			}
+			return nil, &DuplicateHeaderError{name, at}
+		case r.Config.DuplicateHeaders == DuplicatesSuffix:
+			for n := 2; ; n++ {
+				s := r.Config.HeaderNormalization.apply(name + "_" + strconv.Itoa(n))
+				if _, ok := index[s]; !ok && !slices.Contains(header, s) {
+					index[s] = i
+					break
+				}
+			}
+		}
+	}
+	return index, nil
+}
+
+// Reads the header, as by ReadHeader, and checks that it has the
+// required columns, in that order and no others, failing with a
+// *HeaderError listing the differences otherwise. Names are matched
+// as by HeaderIndex.
+func (r *Reader) ExpectHeader(required []string, opts ...HeaderOption) error {
+	header, e := r.ReadHeader()
+	if e != nil {
+		return e
+	}
+	var he HeaderError
+	var present []string // required columns found, in required order
+	for _, name := range required {
+		if _, ok := r.HeaderIndex(name); ok {
+			present = append(present, name)
+		} else {
+			he.Missing = append(he.Missing, name)
+		}
+	}
+	if !slices.Contains(opts, AllowExtraColumns) {
+		// a column is expected if a required name picks it, or
+		// shares a name with one that does
+		norm := r.Config.HeaderNormalization.apply
+		want := make(map[int]bool, len(present))
+		names := make(map[string]bool, len(present))
+		for _, name := range present {
+			i, _ := r.HeaderIndex(name)
+			want[i], names[norm(name)] = true, true
+		}
+		for i, name := range header {
+			if !want[i] && !names[norm(name)] {
+				he.Extra = append(he.Extra, name)
+			}
+		}
+	}
+	if !slices.Contains(opts, IgnoreColumnOrder) {
+		sorted := slices.Clone(present)
+		slices.SortStableFunc(sorted, func(a, b string) int {
+			i, _ := r.HeaderIndex(a)
+			j, _ := r.HeaderIndex(b)
+			return i - j
+		})
+		for k, name := range present {
+			if sorted[k] != name {
+				he.OutOfOrder = append(he.OutOfOrder, name)
+			}
+		}
+	}
+	if he.Missing == nil && he.Extra == nil && he.OutOfOrder == nil {
+		return nil
+	}
+	return &he
+}
+
+// Makes ReadRow, and the methods built on it, return only the columns
+// of the header called names, in that order. The fields of other
+// columns are parsed but not kept. Names are matched as by
+// HeaderIndex. No names makes rows be returned whole again.
+func (r *Reader) SelectColumns(names ...string) error {
+	if r.header == nil {
+		return ErrNoHeader
+	}
+	idx := make([]int, len(names))
+	for k, name := range names {
+		i, ok := r.HeaderIndex(name)
+		if !ok {
+			return &UnknownColumnError{name}
+		}
+		idx[k] = i
+	}
+	r.SelectIndices(idx...)
+	return nil
+}
+
+// Makes ReadRow, and the methods built on it, return only the fields
+// at the 0-based positions idx, in that order, for input without a
+// header. A position past the end of a row, or negative, gives "",
+// unless Config.Strict is set, which makes such rows fail with a
+// *FieldCountError. No positions makes rows be returned whole again.
+func (r *Reader) SelectIndices(idx ...int) {
+	if len(idx) == 0 {
+		r.selected, r.wanted = nil, nil
+		return
+	}
+	r.selected = idx
+	r.wanted = make([]bool, max(slices.Max(idx)+1, 0))
+	for _, i := range idx {
+		if i >= 0 {
+			r.wanted[i] = true
+		}
+	}
+}
+
+// Returns the selected fields of row, and keeps their marks.
+func (r *Reader) project(row []string) ([]string, error) {
+	if r.Config.Strict && (len(row) < len(r.wanted) || slices.Min(r.selected) < 0) {
+		return nil, &FieldCountError{r.rows, len(r.wanted), len(row)}
+	}
+	out := make([]string, len(r.selected))
+	picked := r.pickedMarks[:0]
+	for k, i := range r.selected {
+		if i >= 0 && i < len(row) {
+			out[k] = row[i]
+		}
+		if i >= 0 && i < len(r.marks) {
+			picked = append(picked, r.marks[i])
+		} else if len(r.marks) > 0 {
+			picked = append(picked, cellMark{})
+		}
+	}
+	r.marks, r.pickedMarks = picked, r.marks
+	return out, nil
+}
+
+// Returns the header read by ReadHeader, or nil if none has been
+// read.
+func (r *Reader) Header() []string {
+	return r.header
+}
+
+// Returns the position of the column called name in the header, and
+// whether there is one. name is normalized like the header, and
+// names that appear more than once are resolved as set by
+// Config.DuplicateHeaders.
+func (r *Reader) HeaderIndex(name string) (int, bool) {
+	i, ok := r.headerIndex[r.Config.HeaderNormalization.apply(name)]
+	return i, ok
+}
+
+// Reads a single row like ReadRow, keyed by the names in the header
+// as normalized by Config.HeaderNormalization. The header is read
+// first if ReadHeader has not been called. Columns that share a name
+// are keyed as set by Config.DuplicateHeaders, and only those chosen
+// by SelectColumns are kept. Columns missing from a short row are
+// mapped to "", unless Config.Strict is set, which makes such rows
+// fail with a *FieldCountError. Fields past the header are kept as
+// set by Config.ExtraFieldsKey.
+func (r *Reader) ReadRowMap() (map[string]string, error) {
+	if _, e := r.ReadHeader(); e != nil {
+		return nil, e
+	}
+	row, e := r.readFull()
+	if row == nil {
+		return nil, e
+	}
+	n := len(r.header)
+	if len(row) < n && r.Config.Strict || len(row) > n && r.Config.ExtraFieldsKey == "" {
+		return nil, &FieldCountError{r.rows, n, len(row)}
+	}
+	m := make(map[string]string, n+1)
+	for name, i := range r.headerIndex {
+		if r.selected != nil && (i >= len(r.wanted) || !r.wanted[i]) {
+			continue
+		}
+		if i < len(row) {
+			m[name] = row[i]
+		} else {
+			m[name] = ""
+		}
+	}
+	if len(row) > n {
+		m[r.Config.ExtraFieldsKey] = strings.Join(row[n:], r.Config.delim())
+	}
+	return m, e
+}
+
+// Consumes a first line of the form "sep=X", making X the field
+// delimiter. Any other first line is left in place.
+func (r *Reader) readSepDirective() error {
+	var line []byte
+	for len(line) < len("sep=")+utf8.UTFMax {
+		b, e := r.readByte()
+		if e != nil && e != io.EOF {
+			return e
+		}
+		if e == nil && b != r.Config.recordDelim() && b != '\r' {
+			line = append(line, b)
+			continue
+		}
+		d, n := utf8.DecodeRune(line[min(len(line), 4):])
+		if string(line[:min(len(line), 4)]) == "sep=" && n == len(line)-4 && d != utf8.RuneError {
+			if e == nil {
+				if _, e = r.atRecordEnd(b); e != nil {
+					return e
+				}
+			}
+			r.setSepDelim(d)
+			return nil
+		}
+		if e == nil {
+			r.unreadByte(b)
+		}
+		break
+	}
+	for i := len(line) - 1; i >= 0; i-- {
+		r.unreadByte(line[i])
+	}
+	return nil
+}
+
+// Makes d the field delimiter, as a sep= directive does.
+func (r *Reader) setSepDelim(d rune) {
+	saved := r.Config
+	r.beforeSep = &saved
+	r.Config.FieldDelim, r.Config.FieldDelimRune, r.Config.FieldDelimString = byte(d), 0, ""
+	if d >= utf8.RuneSelf {
+		r.Config.FieldDelimRune = d
+	}
+}
+
+// Discards the first SkipLines lines of input as they are.
+func (r *Reader) skipPreamble() error {
+	for n := 0; n < r.Config.SkipLines; {
+		b, e := r.readByte()
+		if e != nil {
+			return e
+		}
+		end, e := r.atRecordEnd(b)
+		if e != nil {
+			return e
+		}
+		if end {
+			n += 1
+		}
+	}
+	return nil
+}
+
+// Consumes whatever comes before the next row: the start of the
+// input on the first call, then any lines to be skipped.
+func (r *Reader) startRow() error {
+	if !r.started {
+		if e := r.Config.Validate(); e != nil {
+			return e
+		}
+		r.started = true
+		if e := r.skipBOM(); e != nil {
+			return e
+		}
+		if r.Config.HonorSepDirective {
+			if e := r.readSepDirective(); e != nil {
+				return e
+			}
+		}
+		if e := r.skipPreamble(); e != nil {
+			return e
+		}
+	}
+	if r.Config.Comment != 0 || r.Config.SkipBlankLines {
+		return r.skipLines()
+	}
+	return nil
+}
+
+func (r *Reader) readRow() ([]string, error) {
+	var result []string
+	r.marks = r.marks[:0]
+	if e := r.startRow(); e != nil {
+		return nil, e
+	}
+	if r.Config.CollapseDelims {
+		// leading delimiters don't make empty fields
+		switch end, e := r.skipDelims(); {
+		case e != nil:
+			return nil, e
+		case end == endOfInput:
+			return nil, io.EOF
+		case end == endOfRecord:
+			return r.emptyRow(), nil
+		}
+	}
+	// fields of columns not selected are parsed but not kept, unless
+	// something other than the selection looks at them
+	picking := r.selected != nil && !r.keepsAll()
+	if picking {
+		defer func() { r.skipping = false }()
+	}
+	for {
+		r.skipping = picking && (len(result) >= len(r.wanted) || !r.wanted[len(result)])
+		c, end, e := r.parseCell()
+		if e != nil {
+			if e == errFieldTooLong {
+				e = &FieldSizeError{r.rows + 1, len(result), r.Config.MaxFieldSize}
+			}
+			if e == io.EOF && len(result) > 0 {
+				// a delimiter just before the end of input
+				// leaves an empty trailing field
+				r.mark(cellMark{})
+				return append(result, r.Config.EmptyUnquotedAs), nil
+			}
+			return result, e
+		}
+		if r.Config.FallbackWindows1252 && !utf8.ValidString(c) {
+			c = decodeWindows1252(c)
+		}
+		if r.Config.EscapeNewlines && strings.IndexByte(c, '\\') >= 0 {
+			c = newlineUnescaper.Replace(c)
+		}
+		if r.Config.ValidateUTF8 && !utf8.ValidString(c) {
+			return nil, &UTF8Error{r.rows + 1, len(result), invalidUTF8(c)}
+		}
+		if c == "" && !r.cell.quoted {
+			c = r.Config.EmptyUnquotedAs
+		}
+		result = append(result, c)
+		r.mark(r.cell)
+		if end != endOfField {
+			break
+		}
+		if r.Config.CollapseDelims {
+			if end, e = r.skipDelims(); e != nil {
+				return nil, e
+			}
+			if end != endOfField {
+				break
+			}
+		}
+		if r.Config.MaxColumns > 0 && len(result) == r.Config.MaxColumns {
+			if r.Config.TruncateRows {
+				// fields past the limit are parsed but not kept
+				return result, r.skipRow(len(result))
+			}
+			return nil, &ColumnLimitError{r.rows + 1, r.Config.MaxColumns}
+		}
+	}
+	return result, nil
+}
+
+// Discards the next n rows, returning how many were skipped. Fewer
+// than n are skipped only along with an error, io.EOF if the input
+// ran out. Skipped rows are counted in row numbers and checked for
+// syntax errors, but their fields are neither kept nor checked
+// against the Config.
+func (r *Reader) Skip(n int) (skipped int, err error) {
+	for ; skipped < n; skipped++ {
+		if r.filter != nil || r.Config.StopAtPrefix != "" {
+			// the fields are needed to tell which rows count
+			_, err = r.ReadRow()
+		} else {
+			err = r.skipNext()
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Parses the next row without building its fields.
+func (r *Reader) skipNext() error {
+	if e := r.startRow(); e != nil {
+		return e
+	}
+	b, e := r.readByte()
+	if e != nil {
+		return e
+	}
+	r.unreadByte(b)
+	r.skipping = true
+	e = r.skipRow(0)
+	r.skipping = false
+	if e != nil {
+		return e
+	}
+	r.rows += 1
+	r.checkpoint()
+	return nil
+}
+
+// Parses and discards the rest of the current row, starting with
+// the field at index field.
+func (r *Reader) skipRow(field int) error {
+	for ; ; field++ {
+		_, end, e := r.parseCell()
+		if e == errFieldTooLong {
+			e = &FieldSizeError{r.rows + 1, field, r.Config.MaxFieldSize}
+		}
+		if e != nil || end != endOfField {
+			if e == io.EOF {
+				e = nil
+			}
+			return e
+		}
+	}
+}
+
+// Returns a row holding a single empty field.
+func (r *Reader) emptyRow() []string {
+	r.mark(cellMark{})
+	return []string{r.Config.EmptyUnquotedAs}
+}
+
+// Consumes a run of field delimiters. Returns endOfField if a field
+// follows, or how the row ended otherwise.
+func (r *Reader) skipDelims() (int, error) {
+	for {
+		b, e := r.readByte()
+		if e != nil {
+			if e == io.EOF {
+				return endOfInput, nil
+			}
+			return endOfInput, e
+		}
+		if ok, e := r.atDelim(b); ok || e != nil {
+			if e != nil {
+				return endOfInput, e
+			}
+			continue
+		}
+		if ok, e := r.atRecordEnd(b); ok || e != nil {
+			return endOfRecord, e
+		}
+		r.unreadByte(b)
+		return endOfField, nil
+	}
+}
+
+// Reads the remaining rows, or at most MaxRows of them if set.
+func (r *Reader) ReadAll() ([][]string, error) {
+	rows := make([][]string, 0, 32)
+	for r.Config.MaxRows <= 0 || len(rows) < r.Config.MaxRows {
+		row, e := r.ReadRow()
+		if e != nil {
+			if e == io.EOF {
+				break
+			}
+			return nil, e
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// Like ReadAll, but closes rc once reading stops, whether or not
+// an error occurred. A parse error takes precedence over an error
+// from closing.
+func ReadAllClose(rc io.ReadCloser) ([][]string, error) {
+	r := NewReader(rc)
+	rows, e := r.ReadAll()
+	if ce := r.Close(); e == nil && ce != nil {
+		return nil, ce
+	}
+	return rows, e
+}
+
+// Reads up to n rows. If the input ends first, the rows read so far
+// are returned along with io.EOF. Later calls carry on from where
+// the last one stopped. An n of 0 or less reads nothing.
+func (r *Reader) ReadN(n int) ([][]string, error) {
+	rows := make([][]string, 0, max(0, min(n, 32)))
+	for len(rows) < n {
+		row, e := r.ReadRow()
+		if e != nil {
+			return rows, e
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// Returns an iterator over the remaining rows. It stops at the end
+// of the input, or after yielding the first error other than io.EOF
+// along with a nil row.
+func (r *Reader) Rows() iter.Seq2[[]string, error] {
+	return func(yield func([]string, error) bool) {
+		for {
+			row, e := r.ReadRow()
+			if e == io.EOF {
+				if row != nil {
+					yield(row, nil)
+				}
+				return
+			}
+			if e != nil {
+				yield(nil, e)
+				return
+			}
+			if !yield(row, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Returns an iterator over the rows of r read with the default
+// Config.
+func Rows(r io.Reader) iter.Seq2[[]string, error] {
+	return NewReader(r).Rows()
+}
+
+// Reads rows one at a time in the manner of bufio.Scanner:
+//
+//	for s.Scan() {
+//		use(s.Row())
+//	}
+//	if e := s.Err(); e != nil {
+//		...
+//	}
+type RowScanner struct {
+	r    *Reader
+	row  []string
+	err  error
+	done bool
+}
+
+// Creates a RowScanner reading from r with the default Config, which
+// may be changed through Reader before the first call to Scan.
+func NewRowScanner(r io.Reader) *RowScanner {
+	return &RowScanner{r: NewReader(r)}
+}
+
+// Creates a RowScanner reading the remaining rows of r, using its
+// Config.
+func (r *Reader) Scanner() *RowScanner {
+	return &RowScanner{r: r}
+}
+
+// Returns the Reader rows are read from.
+func (s *RowScanner) Reader() *Reader {
+	return s.r
+}
+
+// Reads the next row, making it available from Row. Returns false
+// once the input ends or an error occurs.
+func (s *RowScanner) Scan() bool {
+	if s.done {
+		s.row = nil
+		return false
+	}
+	row, e := s.r.ReadRow()
+	if e != nil {
+		s.done = true
+		if e != io.EOF {
+			s.err, row = e, nil
+		}
+	}
+	s.row = row
+	return row != nil
+}
+
+// Returns the row read by the last call to Scan.
+func (s *RowScanner) Row() []string {
+	return s.row
+}
+
+// Returns the first error other than io.EOF met by Scan.
+func (s *RowScanner) Err() error {
+	return s.err
+}
+
+// Convenience function that reads the whole CSV file into memory and returns it as
+// [][]string (a slice of rows, which are a slice of strings).
+func ReadAll(r io.Reader) ([][]string, error) {
+	return NewReader(r).ReadAll()
+}
+
+// Reads the whole CSV file as by ReadRowMap, with the first row as
+// the header. Empty input, or input with only a header, gives an
+// empty slice.
+func ReadAllMaps(r io.Reader) ([]map[string]string, error) {
+	p := NewReader(r)
+	rows := make([]map[string]string, 0, 32)
+	if _, e := p.ReadHeader(); e == io.EOF {
+		return rows, nil
+	} else if e != nil {
+		return nil, e
+	}
+	for {
+		m, e := p.ReadRowMap()
+		if e == io.EOF {
+			return rows, nil
+		}
+		if e != nil {
+			return nil, e
+		}
+		rows = append(rows, m)
+	}
+}
+
+// Delimiters considered by DetectConfig, in order of preference.
+var detectDelims = []byte{',', ';', '\t', '|'}
+
+// Returned by DetectConfig for a negative sample size.
+var ErrSampleSize = errors.New("negative sample size")
+
+// Guesses a Config for the CSV in r from its first sampleSize bytes:
+// the field delimiter (one of ',', ';', '\t' or '|') that gives the
+// most consistent number of fields per row, and whether fields are
+// padded with spaces. Line endings need no configuration as the
+// default RecordDelim accepts "\n", "\r\n" and "\r" alike. The
+// returned io.Reader yields the sample followed by the rest of r.
+func DetectConfig(r io.Reader, sampleSize int) (Config, io.Reader, error) {
+	if sampleSize < 0 {
+		return Config{}, nil, ErrSampleSize
+	}
+	sample := make([]byte, sampleSize)
+	n, e := io.ReadFull(r, sample)
+	if e != nil && e != io.EOF && e != io.ErrUnexpectedEOF {
+		return Config{}, nil, e
+	}
+	sample = sample[:n]
+	rest := io.MultiReader(bytes.NewReader(sample), r)
+	if n == sampleSize {
+		// the last row may be cut short, so leave it out
+		if i := bytes.LastIndexAny(sample, "\r\n"); i >= 0 {
+			sample = sample[:i+1]
+		}
+	}
+
+	config := DefaultConfig()
+	best := 0.0
+	for _, d := range detectDelims {
+		p := NewReader(bytes.NewReader(sample))
+		p.Config.FieldDelim = d
+		p.Config.LazyQuotes = true
+		p.Config.SkipBlankLines = true
+		rows, e := p.ReadAll()
+		if e != nil || len(rows) == 0 {
+			continue
+		}
+		counts := make(map[int]int)
+		mode := 0
+		for _, row := range rows {
+			counts[len(row)] += 1
+			if counts[len(row)] > counts[mode] || (counts[len(row)] == counts[mode] && len(row) > mode) {
+				mode = len(row)
+			}
+		}
+		if mode < 2 {
+			continue
+		}
+		// favour consistency, then more fields per row
+		score := float64(counts[mode])/float64(len(rows)) + float64(mode)/1e6
+		if score > best {
+			best = score
+			config.FieldDelim = d
+			config.TrimSpaces = paddedFields(rows)
+		}
+	}
+	return config, rest, nil
+}
+
+// Reports whether most fields after the first in each row start
+// with a space.
+func paddedFields(rows [][]string) bool {
+	padded, total := 0, 0
+	for _, row := range rows {
+		for _, cell := range row[min(1, len(row)):] {
+			if cell != "" {
+				total += 1
+				if cell[0] == ' ' {
+					padded += 1
+				}
+			}
+		}
+	}
+	return total > 0 && padded*2 > total
+}
+
+// Writes CSV. Config is validated when the first row is written, or
+// by NewWriterConfig. It should not be changed after that, as later
+// changes are not validated and may give output that cannot be read
+// back.
+type Writer struct {
+	out      *bufio.Writer
+	buf      *bufio.Writer // wraps destinations that are not buffered
+	gz       *gzip.Writer  // compresses output for NewGzipWriter
+	closer   io.Closer     // the file opened by OpenAppend
+	closed   bool
+	inRow    bool   // between BeginRow and EndRow
+	rowCells int    // fields written since BeginRow
+	rowErr   error  // why a field since BeginRow could not be written
+	chunk    []byte // buffer for WriteCellFrom
+	// whether WriteBOM has been honoured for this destination
+	wroteBOM bool
+	footer   func(rowsWritten int) []string
+	started  bool
+	rows     int    // number of rows written so far
+	fields   int    // expected fields per row, once known
+	quoted   []bool // whether each field of the row being written is quoted
+	header   []string
+	named    []string // header given to SetHeader, kept by Reset
+	cells    []string // row built by WriteRowMap or WriteRowAny
+	safe     []string // row as changed by SanitizeFormulas or EscapeNewlines
+	padded   []string // row as changed by PadRowsTo
+	// indices of the fields to write, as set by SetColumnOrder or
+	// SetColumnIndices
+	project     []int
+	projected   []string
+	outNames    []string // output columns given to SetColumnOrder
+	transform   func(row, col int, name, value string) string
+	transformed []string
+	nulls       []bool // which fields are nil, while in WriteRowPtr
+	// the last row's end is held back by NoFinalNewline
+	endPending bool
+	count      int64 // bytes written, buffered or not
+	stats      WriterStats
+	// whether header was written by WriteHeader
+	wroteHeader bool
+	Config      Config
+}
+
+// Counts of what a Writer has written, as returned by Stats.
+type WriterStats struct {
+	Rows        int // rows, including a header and footer
+	Cells       int
+	QuotedCells int
+	MaxWidth    int // the most fields in a row
+}
+
+// Creates a writer with the default Config. w is wrapped in a
+// bufio.Writer unless it is one already.
+func NewWriter(w io.Writer) *Writer {
+	p := &Writer{Config: DefaultConfig()}
+	p.setDest(w, 0)
+	return p
+}
+
+// Creates a writer with the given Config, or returns a *ConfigError
+// if the Config is invalid. w is wrapped as by NewWriter.
+func NewWriterConfig(w io.Writer, config Config) (*Writer, error) {
+	if e := config.Validate(); e != nil {
+		return nil, e
+	}
+	p := &Writer{Config: config, started: true}
+	p.setDest(w, 0)
+	return p, nil
+}
+
+// Creates a writer with the default Config that compresses its output
+// to w with gzip. Close must be called to end the gzip stream; it
+// does not close w. ByteCount counts bytes before compression.
+func NewGzipWriter(w io.Writer) (*Writer, error) {
+	gz, e := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	if e != nil {
+		return nil, e
+	}
+	p := NewWriter(gz)
+	p.gz = gz
+	return p, nil
+}
+
+// Opens the file at path, creating it if need be, for a Writer with
+// the given Config to add rows to the end of it. If the file does
+// not end with the end of a row, one is written ahead of the first
+// new row so that it starts on a line of its own. Close closes the
+// file.
+func OpenAppend(path string, config Config) (*Writer, error) {
+	w, e := NewWriterConfig(nil, config)
+	if e != nil {
+		return nil, e
+	}
+	f, e := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if e != nil {
+		return nil, e
+	}
+	w.setDest(f, 0)
+	w.closer = f
+	info, e := f.Stat()
+	if e == nil && info.Size() > 0 {
+		// the file already has its start, BOM or not
+		w.wroteBOM = true
+		end := "\n"
+		if config.RecordDelimOut != "" {
+			end = config.RecordDelimOut
+		}
+		tail := make([]byte, min(int64(len(end)), info.Size()))
+		if _, e = f.ReadAt(tail, info.Size()-int64(len(tail))); e == nil && string(tail) != end &&
+			(config.RecordDelimOut != "" || tail[len(tail)-1] != '\r') {
+			w.endPending = true
+		}
+	}
+	if e != nil {
+		f.Close()
+		return nil, e
+	}
+	return w, nil
+}
+
+// Like NewWriter, but with a buffer of at least size bytes. A
+// *bufio.Writer with a buffer that large is used as it is.
+func NewWriterSize(w io.Writer, size int) *Writer {
+	p := &Writer{Config: DefaultConfig()}
+	p.setDest(w, size)
+	return p
+}
+
+// Makes dst the destination of output, wrapping it in the Writer's
+// own bufio.Writer, of at least size bytes if positive, unless it is
+// a large enough *bufio.Writer already.
+func (w *Writer) setDest(dst io.Writer, size int) {
+	if bw, ok := dst.(*bufio.Writer); ok && bw.Size() >= size {
+		w.out = bw
+		return
+	}
+	if w.buf == nil || w.buf.Size() < size {
+		if size > 0 {
+			w.buf = bufio.NewWriterSize(dst, size)
+		} else {
+			w.buf = bufio.NewWriter(dst)
+		}
+	} else {
+		w.buf.Reset(dst)
+	}
+	w.out = w.buf
+}
+
+// Discards all state, including rows not yet flushed from the
+// Writer's own buffer, and makes w write to dst, keeping its Config
+// and buffers. As with Reader.Reset, what was set by the Set methods
+// (SetHeader, SetColumnOrder, SetColumnIndices, SetCellTransform and
+// SetFooter) is kept, but not a header written by WriteHeader. A *bufio.Writer given as the earlier
+// destination is left as it is. The gzip stream of a Writer created
+// by NewGzipWriter is ended, and a new one started on dst; the file
+// of one created by OpenAppend is closed. Errors from doing so are
+// not reported, so Close should be called first where they matter.
+func (w *Writer) Reset(dst io.Writer) {
+	if w.gz != nil {
+		w.gz.Close()
+		w.gz.Reset(dst)
+		dst = w.gz
+	}
+	if w.closer != nil {
+		w.closer.Close()
+	}
+	var header []string
+	if w.named != nil {
+		header = append(w.header[:0], w.named...)
+	}
+	*w = Writer{
+		buf:    w.buf,
+		gz:     w.gz,
+		quoted: w.quoted[:0],
+		cells:  w.cells[:0],
+		safe:   w.safe[:0],
+		padded: w.padded[:0],
+		nulls:  w.nulls[:0],
+		Config: w.Config,
+
+		wroteBOM:  w.wroteBOM,
+		header:    header,
+		named:     w.named,
+		project:   w.project,
+		outNames:  w.outNames,
+		transform: w.transform,
+		footer:    w.footer,
+	}
+	w.setDest(dst, 0)
+}
+
+func (w *Writer) needsQuotes(s string) bool {
+	if len(s) == 0 {
+		return w.Config.EmptyUnquotedAs != ""
+	}
+	if s[0] == ' ' || s[len(s)-1] == ' ' {
+		return true
+	}
+	q := rune(w.Config.quote())
+	for _, c := range s {
+		switch c {
+		case '\n', '\r', q:
+			return true
+		}
+	}
+	if t := w.Config.RecordDelimOut; t != "" && strings.Contains(s, t) {
+		return true
+	}
+	// a bare InlineComment byte would end the row
+	if ic := w.Config.InlineComment; ic != 0 && strings.IndexByte(s, ic) >= 0 {
+		return true
+	}
+	d := w.Config.delim()
+	// A cell ending in part of a multi-byte delimiter would run
+	// into the delimiter that follows it.
+	for i := 1; i < len(d); i++ {
+		if strings.HasSuffix(s, d[:i]) {
+			return true
+		}
+	}
+	return strings.Contains(s, d)
+}
+
+// Reports whether s is a decimal number such as "-12" or "1.5e3".
+func isNumeric(s string) bool {
+	sign := func() {
+		if s != "" && (s[0] == '+' || s[0] == '-') {
+			s = s[1:]
+		}
+	}
+	digits := func() int {
+		n := len(s) - len(strings.TrimLeft(s, "0123456789"))
+		s = s[n:]
+		return n
+	}
+	sign()
+	n := digits()
+	if strings.HasPrefix(s, ".") {
+		s = s[1:]
+		n += digits()
+	}
+	if n > 0 && s != "" && (s[0] == 'e' || s[0] == 'E') {
+		s = s[1:]
+		sign()
+		if digits() == 0 {
+			return false
+		}
+	}
+	return n > 0 && s == ""
+}
+
+// Returns cell with FormulaGuard ahead of it if a spreadsheet could
+// take it for a formula.
+func (w *Writer) sanitize(cell string) string {
+	if cell == "" || strings.IndexByte("=+-@\t\r", cell[0]) < 0 || isNumeric(cell) {
+		return cell
+	}
+	g := w.Config.FormulaGuard
+	if g == 0 {
+		g = '\''
+	}
+	return string(g) + cell
+}
+
+// Reports whether the field at index field holding cell is to be
+// quoted.
+func (w *Writer) quoteCell(field int, cell string) (bool, error) {
+	if u := w.Config.EmptyUnquotedAs; u != "" && cell == u {
+		return false, nil
+	}
+	if w.Config.PreferEscape {
+		return cell == "" && w.Config.EmptyUnquotedAs != "", nil
+	}
+	// a row starting with the comment byte would be skipped
+	needed := w.needsQuotes(cell) || (field == 0 && w.startsComment(cell))
+	switch w.Config.Quoting {
+	case QuoteAll:
+		return true, nil
+	case QuoteNonNumeric:
+		if !isNumeric(cell) {
+			return true, nil
+		}
+	case QuoteNever:
+		if needed {
+			return false, &QuoteError{w.rows + 1, field, cell}
+		}
+		return false, nil
+	}
+	return needed, nil
+}
+
+// Reports whether the first non-space byte of cell is Config.Comment.
+func (w *Writer) startsComment(cell string) bool {
+	s := strings.TrimLeft(cell, " ")
+	return w.Config.Comment != 0 && s != "" && s[0] == w.Config.Comment
+}
+
+// Writes cell, the field at index field of its row.
+func (w *Writer) writeCell(field int, cell string, quoted bool) (e error) {
+	if u := w.Config.EmptyUnquotedAs; u != "" && cell == u {
+		return nil
+	}
+	if quoted {
+		q := w.Config.quote()
+		e = w.writeByte(q)
+		if e != nil {
+			return
+		}
+		esc := w.Config.Escape
+		for i := 0; i < len(cell); i++ {
+			b := cell[i]
+			if b == q || (b == esc && esc != 0) {
+				// a quote is doubled, Escape escaped
+				if e = w.writeByte(b); e != nil {
+					return
+				}
+			}
+			if e = w.writeByte(b); e != nil {
+				return
+			}
+		}
+		e = w.writeByte(q)
+		if e != nil {
+			return
+		}
+	} else if w.Config.PreferEscape {
+		e = w.writeEscaped(cell, field == 0)
+	} else if esc := w.Config.Escape; esc != 0 && strings.IndexByte(cell, esc) >= 0 {
+		// the Reader takes Escape as such even in bare fields
+		for i := 0; i < len(cell); i++ {
+			if cell[i] == esc {
+				if e = w.writeByte(esc); e != nil {
+					return
+				}
+			}
+			if e = w.writeByte(cell[i]); e != nil {
+				return
+			}
+		}
+	} else {
+		e = w.writeString(cell)
+	}
+	return
+}
+
+// Writes cell with Escape ahead of each byte that would otherwise
+// be misread, including InlineComment. In the first field of a row,
+// that includes a leading Comment byte.
+func (w *Writer) writeEscaped(cell string, first bool) error {
+	c := &w.Config
+	d, t := c.delim(), c.RecordDelimOut
+	for i := 0; i < len(cell); i++ {
+		b := cell[i]
+		escape := b == c.Escape || b == c.quote() || b == d[0] || (t != "" && b == t[0]) ||
+			(b == ' ' && (i == 0 || i == len(cell)-1)) ||
+			(first && i == 0 && c.Comment != 0 && b == c.Comment) ||
+			(c.InlineComment != 0 && b == c.InlineComment)
+		switch b {
+		case '\n':
+			b, escape = 'n', true
+		case '\r':
+			b, escape = 'r', true
+		}
+		if escape {
+			if e := w.writeByte(c.Escape); e != nil {
+				return e
+			}
+		}
+		if e := w.writeByte(b); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeByte(b byte) error {
+	e := w.out.WriteByte(b)
+	if e == nil {
+		w.count += 1
+	}
+	return e
+}
+
+func (w *Writer) writeString(s string) error {
+	n, e := w.out.WriteString(s)
+	w.count += int64(n)
+	return e
+}
+
+func (w *Writer) writeDelim() (e error) {
+	if w.Config.FieldDelimString == "" && w.Config.FieldDelimRune == 0 {
+		return w.writeByte(w.Config.FieldDelim)
+	}
+	e = w.writeString(w.Config.delim())
+	return
+}
+
+// Writes a row. Rows are buffered, so Flush must be called once
+// writing is done for the last of them to reach the underlying
+// io.Writer. Code written when WriteRow flushed every row can call
+// Flush after each WriteRow to keep that behaviour.
+func (w *Writer) WriteRow(row []string) error {
+	if w.project != nil {
+		w.projected = w.projected[:0]
+		for _, j := range w.project {
+			if j >= 0 && j < len(row) {
+				w.projected = append(w.projected, row[j])
+			} else {
+				w.projected = append(w.projected, "")
+			}
+		}
+		if len(w.nulls) > 0 {
+			// nulls are indexed like the row written
+			nulls := make([]bool, len(w.project))
+			for i, j := range w.project {
+				nulls[i] = j >= 0 && j < len(w.nulls) && w.nulls[j]
+			}
+			w.nulls = nulls
+		}
+		row = w.projected
+	}
+	if w.transform != nil {
+		w.transformed = w.transformed[:0]
+		for i, cell := range row {
+			if !w.isNull(i) {
+				cell = w.transform(w.rows+1, i, w.columnName(i), cell)
+			}
+			w.transformed = append(w.transformed, cell)
+		}
+		row = w.transformed
+	}
+	return w.writeRow(row)
+}
+
+// Sets a function that WriteRow passes each field through before
+// quoting, given the 1-based row number counting any header, the
+// 0-based index of the field as written, and the name of its column
+// from the header, or "" if there is none. Headers and nil fields
+// written by WriteRowPtr are not passed. A nil f leaves fields as
+// they are.
+func (w *Writer) SetCellTransform(f func(row, col int, name, value string) string) {
+	w.transform = f
+}
+
+// Returns the name of the column written at index col, or "".
+func (w *Writer) columnName(col int) string {
+	if w.outNames != nil {
+		if col < len(w.outNames) {
+			return w.outNames[col]
+		}
+		return ""
+	}
+	if w.project != nil {
+		if col >= len(w.project) {
+			return ""
+		}
+		col = w.project[col]
+	}
+	if col >= 0 && col < len(w.header) {
+		return w.header[col]
+	}
+	return ""
+}
+
+// Validates the Config if that has not been done, and writes a byte
+// order mark if one is due, ahead of the first output.
+func (w *Writer) begin() error {
+	if w.inRow {
+		return ErrRowOrder
+	}
+	if !w.started {
+		if e := w.Config.Validate(); e != nil {
+			return e
+		}
+		w.started = true
+	}
+	if w.Config.WriteBOM && !w.wroteBOM {
+		w.wroteBOM = true
+		return w.writeString("\xEF\xBB\xBF")
+	}
+	return nil
+}
+
+// Writes row as it is.
+func (w *Writer) writeRow(row []string) (e error) {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	if e = w.begin(); e != nil {
+		return
+	}
+	if n := w.Config.PadRowsTo; n > 0 && len(row) != n {
+		if len(row) > n && !w.Config.TruncateRows {
+			return &FieldCountError{w.rows + 1, n, len(row)}
+		}
+		w.padded = append(w.padded[:0], row[:min(n, len(row))]...)
+		for len(w.padded) < n {
+			w.padded = append(w.padded, "")
+		}
+		row = w.padded
+	}
+	if n := w.Config.FieldsPerRecord; n >= 0 {
+		if w.fields == 0 {
+			w.fields = n
+			if n == 0 {
+				w.fields = len(row)
+			}
+		}
+		if len(row) != w.fields {
+			return &FieldCountError{w.rows + 1, w.fields, len(row)}
+		}
+	}
+	if w.Config.SanitizeFormulas || w.Config.EscapeNewlines {
+		w.safe = w.safe[:0]
+		for i, cell := range row {
+			if w.Config.EscapeNewlines && !w.isNull(i) {
+				cell = newlineEscaper.Replace(cell)
+			}
+			if w.Config.SanitizeFormulas && !w.isNull(i) {
+				cell = w.sanitize(cell)
+			}
+			w.safe = append(w.safe, cell)
+		}
+		row = w.safe
+	}
+	// decide on quoting first so that a *QuoteError leaves no
+	// partial row behind
+	quoted := w.quoted[:0]
+	for i, cell := range row {
+		q := false
+		if len(w.nulls) > 0 && cell == w.Config.NullString {
+			// only nulls are written bare
+			q = !w.isNull(i)
+		} else if q, e = w.quoteCell(i, cell); e != nil {
+			return
+		}
+		quoted = append(quoted, q)
+	}
+	w.quoted = quoted
+	if e = w.writePendingEnd(); e != nil {
+		return
+	}
+	for i, cell := range row {
+		if i > 0 {
+			e = w.writeDelim()
+			if e != nil {
+				return
+			}
+		}
+		if w.isNull(i) {
+			e = w.writeString(cell)
+		} else {
+			e = w.writeCell(i, cell, quoted[i])
+		}
+		if e != nil {
+			return
+		}
+		if quoted[i] {
+			w.stats.QuotedCells += 1
+		}
+	}
+	w.rows += 1
+	w.countRow(len(row))
+	return w.endRow()
 }
 
-type Reader struct {
-	tmpbuf bytes.Buffer
-	br     io.ByteReader
-	Config Config
+// Adds a row of n fields to the stats.
+func (w *Writer) countRow(n int) {
+	w.stats.Rows += 1
+	w.stats.Cells += n
+	w.stats.MaxWidth = max(w.stats.MaxWidth, n)
 }
 
-// Creates a reader with the default Config.
-func NewReader(r io.ByteReader) *Reader {
-	return &Reader{br: r, Config: DefaultConfig()}
+// Ends the line just written, or holds its end back if
+// NoFinalNewline is set.
+func (w *Writer) endRow() error {
+	if w.Config.NoFinalNewline {
+		w.endPending = true
+		return nil
+	}
+	return w.writeRecordEnd()
 }
 
-func (r *Reader) parseQuoted() (string, byte, error) {
-	r.tmpbuf.Reset()
-	for {
-		b, e := r.br.ReadByte()
-		if e != nil {
-			if e == io.EOF {
-				e = io.ErrUnexpectedEOF
+// Writes the end of the last line if it was held back.
+func (w *Writer) writePendingEnd() error {
+	if !w.endPending {
+		return nil
+	}
+	w.endPending = false
+	return w.writeRecordEnd()
+}
+
+// Writes the end of a row.
+func (w *Writer) writeRecordEnd() error {
+	if t := w.Config.RecordDelimOut; t != "" {
+		return w.writeString(t)
+	}
+	if w.Config.UseCRLF {
+		return w.writeString("\r\n")
+	}
+	return w.writeByte('\n')
+}
+
+// Writes text as comment lines, each starting with Config.Comment
+// and a space. A line break in text starts a new comment line.
+func (w *Writer) WriteComment(text string) error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	if w.Config.Comment == 0 {
+		return &ConfigError{"Comment", "must be set to write comments"}
+	}
+	if e := w.begin(); e != nil {
+		return e
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	for _, line := range strings.Split(text, "\n") {
+		if e := w.writePendingEnd(); e != nil {
+			return e
+		}
+		if e := w.writeByte(w.Config.Comment); e != nil {
+			return e
+		}
+		if line != "" {
+			if e := w.writeString(" " + line); e != nil {
+				return e
 			}
-			return "", 0, e
 		}
+		if e := w.endRow(); e != nil {
+			return e
+		}
+	}
+	return nil
+}
 
-		if b == '"' {
-			b, e = r.br.ReadByte()
-			if b == '"' && e == nil {
-				// if we got two double-quotes, parse as one
-				r.tmpbuf.WriteByte('"')
-			} else {
-				// eat trailing whitespace
-				for b == ' ' && e == nil {
-					b, e = r.br.ReadByte()
-				}
-				return r.tmpbuf.String(), b, nil
-			}
+// Writes a row like WriteRow, with nil fields written as
+// Config.NullString, unquoted. Fields equal to NullString that are
+// not nil are quoted so that they are not read back as nil by
+// ReadRowPtr.
+func (w *Writer) WriteRowPtr(row []*string) error {
+	w.cells, w.nulls = w.cells[:0], w.nulls[:0]
+	for _, p := range row {
+		if p == nil {
+			w.cells = append(w.cells, w.Config.NullString)
 		} else {
-			// anything not a quote is just copied over
-			r.tmpbuf.WriteByte(b)
+			w.cells = append(w.cells, *p)
 		}
+		w.nulls = append(w.nulls, p == nil)
 	}
-	panic("unreachable")
+	e := w.WriteRow(w.cells)
+	w.nulls = w.nulls[:0]
+	return e
 }
 
-func (r *Reader) parseCell() (string, byte, error) {
-	r.tmpbuf.Reset()
-	b, e := r.br.ReadByte()
-	if r.Config.TrimSpaces {
-		for b == ' ' && e == nil {
-			// eat leading whitespace
-			b, e = r.br.ReadByte()
-		}
+// Reports whether the field at index field of the row being written
+// by WriteRowPtr is nil.
+func (w *Writer) isNull(field int) bool {
+	return field < len(w.nulls) && w.nulls[field]
+}
+
+// Starts a row to be written one field at a time, with WriteCell and
+// WriteCellFrom, and ended with EndRow. Only quoting, as set by the
+// Config, applies to such rows.
+func (w *Writer) BeginRow() error {
+	if w.closed {
+		return ErrWriterClosed
 	}
-	if e == io.EOF {
-		return "", 0, e
+	if e := w.begin(); e != nil {
+		return e
 	}
-	if b == '"' && e == nil {
-		return r.parseQuoted()
+	w.inRow, w.rowCells = true, 0
+	return w.writePendingEnd()
+}
+
+// Writes the next field of a row begun with BeginRow. If it fails,
+// so does EndRow.
+func (w *Writer) WriteCell(value string) (e error) {
+	defer w.failRow(&e)
+	if !w.inRow {
+		return ErrRowOrder
 	}
-	trailing_spaces := 0
-	var last byte
-	for e == nil && b != '\n' && b != r.Config.FieldDelim {
-		if r.Config.TrimSpaces {
-			if b == ' ' || b == '\r' {
-				trailing_spaces += 1
-			} else {
-				trailing_spaces = 0
-			}
-		}
-		r.tmpbuf.WriteByte(b)
-		last = b
-		b, e = r.br.ReadByte()
+	q, e := w.quoteCell(w.rowCells, value)
+	if e != nil {
+		return e
 	}
-	if e != nil && e != io.EOF {
-		return "", 0, e
+	if e = w.nextCell(); e != nil {
+		return e
 	}
-	if last == '\r' && b == '\n' && trailing_spaces == 0 {
-		trailing_spaces = 1
+	if q {
+		w.stats.QuotedCells += 1
 	}
-	s := r.tmpbuf.Bytes()
-	return string(s[0 : len(s)-trailing_spaces]), b, nil
+	return w.writeCell(w.rowCells-1, value, q)
 }
 
-// Reads a single row into a []string.
-func (r *Reader) ReadRow() ([]string, error) {
-	var result []string
+// Writes the next field of a row begun with BeginRow, copying it from
+// r until EOF without holding it in memory. As its contents are not
+// known in advance, the field is always quoted, or escaped with
+// PreferEscape set. Fails with a *QuoteError if Quoting is
+// QuoteNever. If it fails, so does EndRow.
+func (w *Writer) WriteCellFrom(r io.Reader) (e error) {
+	defer w.failRow(&e)
+	if !w.inRow {
+		return ErrRowOrder
+	}
+	if w.Config.Quoting == QuoteNever && !w.Config.PreferEscape {
+		return &QuoteError{w.rows + 1, w.rowCells, "<streamed>"}
+	}
+	if e = w.nextCell(); e != nil {
+		return e
+	}
+	if w.chunk == nil {
+		w.chunk = make([]byte, 32*1024)
+	}
+	q := w.Config.quote()
+	if !w.Config.PreferEscape {
+		w.stats.QuotedCells += 1
+		if e := w.writeByte(q); e != nil {
+			return e
+		}
+	}
+	first := true // before the first byte of the field
 	for {
-		c, b, e := r.parseCell()
-		if e != nil {
-			if e == io.EOF && len(result) > 0 {
-				result = append(result, c)
+		n, e := r.Read(w.chunk)
+		if n > 0 {
+			var we error
+			if w.Config.PreferEscape {
+				we = w.writeEscaped(string(w.chunk[:n]), w.rowCells == 1 && first)
+				first = false
+			} else {
+				we = w.writeQuotedPart(w.chunk[:n], q)
 			}
-			return result, e
-		}
-		result = append(result, c)
-		if b == 0 {
-			break
-		}
-		// Line endings may be '\r\n', so eat '\r'.
-		if b == '\r' {
-			b, e = r.br.ReadByte()
-			if e != nil {
-				return nil, e
+			if we != nil {
+				return we
 			}
 		}
-		if b == r.Config.FieldDelim {
-			continue
-		} else if b == '\n' {
+		if e == io.EOF {
 			break
-		} else {
-			return nil, errors.New("expected , got " + string(int(b)))
+		}
+		if e != nil {
+			return e
 		}
 	}
-	return result, nil
+	if w.Config.PreferEscape {
+		return nil
+	}
+	return w.writeByte(q)
 }
 
-func (r *Reader) ReadAll() ([][]string, error) {
-	rows := make([][]string, 0, 32)
-	for {
-		row, e := r.ReadRow()
+// Writes b, part of the inside of a quoted field, doubling quotes and
+// Escape.
+func (w *Writer) writeQuotedPart(b []byte, q byte) error {
+	esc := w.Config.Escape
+	for len(b) > 0 {
+		i := len(b)
+		if k := bytes.IndexByte(b, q); k >= 0 {
+			i = k
+		}
+		if k := bytes.IndexByte(b[:i], esc); esc != 0 && k >= 0 {
+			i = k
+		}
+		n, e := w.out.Write(b[:i])
+		w.count += int64(n)
+		if e != nil || i == len(b) {
+			return e
+		}
+		e = w.writeByte(b[i])
+		if e == nil {
+			e = w.writeByte(b[i])
+		}
 		if e != nil {
-			if e == io.EOF {
-				break
-			}
-			return nil, e
+			return e
 		}
-		rows = append(rows, row)
+		b = b[i+1:]
 	}
-	return rows, nil
+	return nil
 }
 
-// Convenience function that reads the whole CSV file into memory and returns it as
-// [][]string (a slice of rows, which are a slice of strings).
-func ReadAll(r io.Reader) ([][]string, error) {
-	return NewReader(bufio.NewReader(r)).ReadAll()
+// Writes the delimiter ahead of a field of a row begun with BeginRow.
+func (w *Writer) nextCell() error {
+	if !w.inRow {
+		return ErrRowOrder
+	}
+	w.rowCells += 1
+	if w.rowCells > 1 {
+		return w.writeDelim()
+	}
+	return nil
 }
 
-type Writer struct {
-	out    *bufio.Writer
-	Config Config
+// Keeps *e, if it is the first error in a row begun with BeginRow,
+// to be returned by EndRow.
+func (w *Writer) failRow(e *error) {
+	if *e != nil && w.inRow && w.rowErr == nil {
+		w.rowErr = *e
+	}
 }
 
-func NewWriter(w io.Writer) *Writer {
-	return &Writer{bufio.NewWriter(w), DefaultConfig()}
+// Ends a row begun with BeginRow. Fails with the first error from
+// writing its fields, if any.
+func (w *Writer) EndRow() error {
+	if !w.inRow {
+		return ErrRowOrder
+	}
+	w.inRow = false
+	w.rows += 1
+	w.countRow(w.rowCells)
+	e := w.endRow()
+	if w.rowErr != nil {
+		e, w.rowErr = w.rowErr, nil
+	}
+	return e
 }
 
-func (w *Writer) needsQuotes(s string) bool {
-	if len(s) > 0 {
-		if s[0] == ' ' || s[len(s)-1] == ' ' {
-			return true
+// Sets the column names used by WriteRowMap, without writing them.
+func (w *Writer) SetHeader(header []string) {
+	w.header = append(w.header[:0], header...)
+	w.named = append(w.named[:0], header...)
+}
+
+// Sets the column names used by WriteRowMap and writes them as the
+// first row. When FieldsPerRecord is 0, later rows must then have as
+// many fields as the header.
+func (w *Writer) WriteHeader(header []string) error {
+	if w.wroteHeader {
+		return ErrHeaderWritten
+	}
+	if w.rows > 0 {
+		return ErrHeaderAfterRows
+	}
+	w.header = append(w.header[:0], header...)
+	row := w.header
+	if w.project != nil {
+		// columns the header lacks are named as in the output
+		row = make([]string, len(w.project))
+		for i, j := range w.project {
+			if j >= 0 && j < len(header) {
+				row[i] = header[j]
+			} else if i < len(w.outNames) {
+				row[i] = w.outNames[i]
+			}
 		}
 	}
-	for _, c := range s {
-		switch c {
-		case '\n', '"', '\t', rune(w.Config.FieldDelim):
-			return true
+	if e := w.writeRow(row); e != nil {
+		return e
+	}
+	w.wroteHeader = true
+	return nil
+}
+
+// Makes WriteRow write only the fields of each row at indices, in
+// that order. Indices past the end of a row give empty fields. A nil
+// indices writes rows whole again.
+func (w *Writer) SetColumnIndices(indices []int) {
+	w.project, w.outNames = append([]int(nil), indices...), nil
+	if indices == nil {
+		w.project = nil
+	}
+}
+
+// Makes rows given to WriteRow and WriteRowMap, and the header given
+// to WriteHeader, be taken to hold the columns named in input, and
+// written with the columns named in output instead. Columns missing
+// from output are dropped, and those missing from input are written
+// empty, or with their name in the header. Sets the header used by
+// WriteRowMap to input. Fails if either list names a column twice.
+func (w *Writer) SetColumnOrder(input, output []string) error {
+	pos := make(map[string]int, len(input))
+	for i, name := range input {
+		if _, ok := pos[name]; ok {
+			return fmt.Errorf("column %q named twice in input", name)
+		}
+		pos[name] = i
+	}
+	project := make([]int, len(output))
+	seen := make(map[string]bool, len(output))
+	for i, name := range output {
+		if seen[name] {
+			return fmt.Errorf("column %q named twice in output", name)
+		}
+		seen[name] = true
+		project[i] = -1
+		if j, ok := pos[name]; ok {
+			project[i] = j
 		}
 	}
-	return false
+	w.SetHeader(input)
+	w.project, w.outNames = project, append([]string(nil), output...)
+	return nil
 }
 
-func (w *Writer) writeCell(cell string) (e error) {
-	if w.needsQuotes(cell) {
-		e = w.out.WriteByte('"')
-		if e != nil {
-			return
+// Writes the values in m in header order, with an empty field for
+// each column missing from m. Keys not in the header are ignored
+// unless RejectUnknownKeys is set.
+func (w *Writer) WriteRowMap(m map[string]string) error {
+	if w.header == nil {
+		return ErrNoHeader
+	}
+	w.cells = w.cells[:0]
+	found := 0
+	for _, col := range w.header {
+		v, ok := m[col]
+		if ok {
+			found += 1
 		}
-		for i := 0; i < len(cell); i++ {
-			b := cell[i]
-			if b == '"' {
-				_, e = w.out.WriteString(`""`)
-				if e != nil {
-					return
-				}
-			} else {
-				e = w.out.WriteByte(b)
-				if e != nil {
-					return
-				}
+		w.cells = append(w.cells, v)
+	}
+	if w.Config.RejectUnknownKeys && found < len(m) {
+		var unknown []string
+		for k := range m {
+			if !slices.Contains(w.header, k) {
+				unknown = append(unknown, k)
 			}
 		}
-		e = w.out.WriteByte('"')
+		return &UnknownKeyError{w.rows + 1, slices.Min(unknown)}
+	}
+	return w.WriteRow(w.cells)
+}
+
+// Writes a row of values of any type, formatted by formatValue.
+func (w *Writer) WriteRowAny(cells ...any) error {
+	w.cells = w.cells[:0]
+	for _, v := range cells {
+		s, e := w.formatValue(v)
 		if e != nil {
-			return
+			return e
 		}
-	} else {
-		_, e = w.out.WriteString(cell)
+		w.cells = append(w.cells, s)
 	}
-	return
+	return w.WriteRow(w.cells)
 }
 
-func (w *Writer) WriteRow(row []string) (e error) {
-	for i, cell := range row {
-		if i > 0 {
-			e = w.out.WriteByte(w.Config.FieldDelim)
-			if e != nil {
-				return
-			}
+// Formats v as a field: integers in full, floats as set by
+// FloatFormat, bools as set by BoolFormat, times as set by
+// TimeLayout, nil as empty, and anything else by its String method
+// or fmt.Sprint.
+func (w *Writer) formatValue(v any) (string, error) {
+	switch v := v.(type) {
+	case float32:
+		return w.Config.FloatFormat.format(float64(v), 32)
+	case float64:
+		return w.Config.FloatFormat.format(v, 64)
+	case time.Time:
+		return w.formatTime(v, ""), nil
+	case bool:
+		return w.Config.BoolFormat.format(v), nil
+	}
+	return formatValue(v), nil
+}
+
+// Formats t with layout, as set by TimeLocation and FormatZeroTime.
+// The layouts "unix" and "unixmilli" give seconds and milliseconds
+// since the Unix epoch. An empty layout stands for TimeLayout.
+func (w *Writer) formatTime(t time.Time, layout string) string {
+	if t.IsZero() && !w.Config.FormatZeroTime {
+		return ""
+	}
+	if w.Config.TimeLocation != nil {
+		t = t.In(w.Config.TimeLocation)
+	}
+	switch layout {
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "unixmilli":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	case "":
+		layout = w.Config.TimeLayout
+		if layout == "" {
+			layout = time.RFC3339Nano
 		}
-		e = w.writeCell(cell)
+	}
+	return t.Format(layout)
+}
+
+// Parses s as a time with layout, as formatTime writes it. Times
+// without a zone are taken to be in TimeLocation, or else UTC.
+func (c *Config) parseTime(s, layout string) (time.Time, error) {
+	loc := c.TimeLocation
+	if loc == nil {
+		loc = time.UTC
+	}
+	switch layout {
+	case "unix", "unixmilli":
+		n, e := strconv.ParseInt(s, 10, 64)
 		if e != nil {
-			return
+			return time.Time{}, e
+		}
+		if layout == "unix" {
+			return time.Unix(n, 0).In(loc), nil
+		}
+		return time.UnixMilli(n).In(loc), nil
+	case "":
+		layout = c.TimeLayout
+		if layout == "" {
+			layout = time.RFC3339Nano
 		}
 	}
-	e = w.out.WriteByte('\n')
-	if e != nil {
-		return
+	return time.ParseInLocation(layout, s, loc)
+}
+
+// Formats v as formatValue does, for types that need no Config.
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int:
+		return strconv.FormatInt(int64(v), 10)
+	case int8:
+		return strconv.FormatInt(int64(v), 10)
+	case int16:
+		return strconv.FormatInt(int64(v), 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case uintptr:
+		return strconv.FormatUint(uint64(v), 10)
+	case fmt.Stringer:
+		return v.String()
 	}
-	e = w.out.Flush()
-	return
+	return fmt.Sprint(v)
+}
+
+// Writes any buffered rows to the underlying io.Writer.
+func (w *Writer) Flush() error {
+	if e := w.out.Flush(); e != nil || w.gz == nil {
+		return e
+	}
+	return w.gz.Flush()
+}
+
+// Sets a function to be called by Close with the number of rows
+// written, not counting a header written by WriteHeader. The row it
+// returns, if not nil, is written last.
+func (w *Writer) SetFooter(f func(rowsWritten int) []string) {
+	w.footer = f
+}
+
+// Writes the footer set by SetFooter, flushes, ends the gzip stream
+// of a Writer created by NewGzipWriter and closes the file of one
+// created by OpenAppend. Rows can no longer be written after that.
+// Later calls do nothing.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	var e error
+	if w.footer != nil {
+		n := w.rows
+		if w.wroteHeader {
+			n -= 1
+		}
+		if row := w.footer(n); row != nil {
+			e = w.WriteRow(row)
+		}
+	}
+	w.closed = true
+	if fe := w.Flush(); e == nil {
+		e = fe
+	}
+	if w.gz != nil {
+		if ce := w.gz.Close(); e == nil {
+			e = ce
+		}
+	}
+	if w.closer != nil {
+		if ce := w.closer.Close(); e == nil {
+			e = ce
+		}
+	}
+	return e
+}
+
+// Returns the number of bytes written so far, including any not yet
+// flushed.
+func (w *Writer) ByteCount() int64 {
+	return w.count
+}
+
+// Returns counts of the rows and cells written so far. They are kept
+// across Flush and cleared by Reset.
+func (w *Writer) Stats() WriterStats {
+	return w.stats
+}
+
+// Returns the first error met by an earlier WriteRow or Flush.
+func (w *Writer) Error() error {
+	_, e := w.out.Write(nil)
+	return e
 }
 
+// Writes all the rows and then flushes. With WriteBOM set, the byte
+// order mark is written even if there are no rows.
 func (w *Writer) WriteAll(rows [][]string) error {
+	if e := w.begin(); e != nil {
+		return e
+	}
 	for _, row := range rows {
 		if e := w.WriteRow(row); e != nil {
 			return e
 		}
 	}
+	return w.Flush()
+}
+
+// Writes each row of seq and then flushes. Stops at the first error.
+func (w *Writer) WriteAllSeq(seq iter.Seq[[]string]) error {
+	for row := range seq {
+		if e := w.WriteRow(row); e != nil {
+			return e
+		}
+	}
+	return w.Flush()
+}
+
+// Like WriteAllSeq, but also stops at the first error from seq, such
+// as one yielded by Reader.Rows, and returns it.
+func (w *Writer) WriteAllSeq2(seq iter.Seq2[[]string, error]) error {
+	for row, e := range seq {
+		if e == nil {
+			e = w.WriteRow(row)
+		}
+		if e != nil {
+			return e
+		}
+	}
+	return w.Flush()
+}
+
+// Writes rows as a table for people to read rather than as CSV,
+// like `column -t`: fields are padded with spaces to the display
+// width of the widest field in their column, and columns are set two
+// spaces apart. Wide East Asian characters count as two columns, and
+// combining marks as none. All rows must be known up front, so output
+// is not streamed. Rows end as they do in CSV, and the writer is
+// flushed.
+func (w *Writer) WriteAllAligned(rows [][]string) error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	if e := w.begin(); e != nil {
+		return e
+	}
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], displayWidth(cell))
+		}
+	}
+	for _, row := range rows {
+		if e := w.writePendingEnd(); e != nil {
+			return e
+		}
+		for i, cell := range row {
+			if i > 0 {
+				if e := w.writeString("  "); e != nil {
+					return e
+				}
+			}
+			if e := w.writeString(cell); e != nil {
+				return e
+			}
+			if i < len(row)-1 {
+				pad := widths[i] - displayWidth(cell)
+				if e := w.writeString(strings.Repeat(" ", pad)); e != nil {
+					return e
+				}
+			}
+		}
+		w.rows += 1
+		w.countRow(len(row))
+		if e := w.endRow(); e != nil {
+			return e
+		}
+	}
+	return w.Flush()
+}
+
+// Returns the number of terminal columns s takes up.
+func displayWidth(s string) int {
+	n := 0
+	for _, c := range s {
+		switch {
+		case unicode.In(c, unicode.Mn, unicode.Me, unicode.Cf):
+		case isWide(c):
+			n += 2
+		default:
+			n += 1
+		}
+	}
+	return n
+}
+
+// Reports whether c is an East Asian wide or fullwidth character.
+func isWide(c rune) bool {
+	return c >= 0x1100 && (c <= 0x115F || // Hangul Jamo
+		c >= 0x2E80 && c <= 0xA4CF && c != 0x303F || // CJK ... Yi
+		c >= 0xAC00 && c <= 0xD7A3 || // Hangul syllables
+		c >= 0xF900 && c <= 0xFAFF || // CJK compatibility ideographs
+		c >= 0xFE30 && c <= 0xFE4F || // CJK compatibility forms
+		c >= 0xFF00 && c <= 0xFF60 || // fullwidth forms
+		c >= 0xFFE0 && c <= 0xFFE6 ||
+		c >= 0x1F300 && c <= 0x1F64F || // pictographs and emoticons
+		c >= 0x1F900 && c <= 0x1F9FF ||
+		c >= 0x20000 && c <= 0x3FFFD)
+}
+
+// Describes an error met while writing a chunk in WriteAllChunked.
+type ChunkError struct {
+	Chunk int // 0-based index of the chunk
+	Err   error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chunk %d: %v", e.Chunk, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// Writes rows with the default Config, split into chunks of at most
+// chunkSize rows, each written to a destination got from next and
+// closed once full, or of any size if chunkSize is not positive.
+// Each chunk starts with header, unless it is nil.
+// If there are no rows, a single chunk holds just the header. Errors
+// are returned as a *ChunkError, after closing the chunk being
+// written.
+func WriteAllChunked(rows iter.Seq[[]string], header []string, chunkSize int,
+	next func(chunkIndex int) (io.WriteCloser, error)) error {
+	var dst io.WriteCloser
+	var w *Writer
+	chunk, n := 0, 0
+	fail := func(e error) error {
+		if dst != nil {
+			dst.Close()
+		}
+		return &ChunkError{chunk, e}
+	}
+	finish := func() error {
+		e := w.Flush()
+		if ce := dst.Close(); e == nil {
+			e = ce
+		}
+		dst = nil
+		return e
+	}
+	open := func() error {
+		var e error
+		if dst, e = next(chunk); e != nil {
+			return e
+		}
+		w, n = NewWriter(dst), 0
+		if header != nil {
+			return w.WriteHeader(header)
+		}
+		return nil
+	}
+	for row := range rows {
+		if dst != nil && n == chunkSize {
+			if e := finish(); e != nil {
+				return fail(e)
+			}
+			chunk += 1
+		}
+		if dst == nil {
+			if e := open(); e != nil {
+				return fail(e)
+			}
+		}
+		if e := w.WriteRow(row); e != nil {
+			return fail(e)
+		}
+		n += 1
+	}
+	if w == nil {
+		if e := open(); e != nil {
+			return fail(e)
+		}
+	}
+	if e := finish(); e != nil {
+		return fail(e)
+	}
 	return nil
 }
 
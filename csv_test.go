@@ -1,12 +1,25 @@
 package csv
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
+	"unicode/utf16"
 )
 
 type testHelper struct {
@@ -242,6 +255,2576 @@ func TestSemiDelim(tp *testing.T) {
 	t.checkEq(out.String(), "1;2;3\n4;5;6\n")
 }
 
+func TestComment(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("# header\na,b\n  # indented\n\"# not a comment\",c\n  #tail")
+	p.Config.Comment = '#'
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{
+		{"a", "b"},
+		{"# not a comment", "c"}})
+}
+
+func TestCommentOnly(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("#one\n#two\n")
+	p.Config.Comment = '#'
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(len(rows), 0)
+}
+
+func TestQuoteChar(tp *testing.T) {
+	t := testHelper{tp}
+	in := "'foo, bar',baz\n'it''s',\"x\"\n"
+	config := DefaultConfig()
+	config.QuoteChar = '\''
+	p := str2Reader(in)
+	p.Config = config
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{
+		{"foo, bar", "baz"},
+		{"it's", `"x"`}})
+
+	out := bytes.NewBuffer(nil)
+	w := NewWriter(out)
+	w.Config = config
+	t.checkNoErr(w.WriteAll(rows))
+	t.checkEq(out.String(), "'foo, bar',baz\n'it''s',\"x\"\n")
+}
+
+func TestLazyQuotes(tp *testing.T) {
+	t := testHelper{tp}
+	var cases = []struct {
+		in     string
+		strict []string
+		err    error
+		lazy   []string
+	}{
+		{`5" pipe,steel`, []string{`5" pipe`, "steel"}, nil, []string{`5" pipe`, "steel"}},
+		{`"a "b" c",d`, nil, ErrQuote, []string{`a "b" c`, "d"}},
+		{`"a" b,c`, nil, ErrQuote, []string{`a" b,c`}},
+		{`"a"  ,b`, []string{"a", "b"}, nil, []string{"a", "b"}},
+		{`"abc`, nil, io.ErrUnexpectedEOF, []string{"abc"}},
+	}
+	for _, tc := range cases {
+		p := str2Reader(tc.in)
+		r, e := p.ReadRow()
+		t.checkEq(errors.Is(e, tc.err), true)
+		t.checkEq(r, tc.strict)
+
+		p = str2Reader(tc.in)
+		p.Config.LazyQuotes = true
+		r, e = p.ReadRow()
+		t.checkNoErr(e)
+		t.checkEq(r, tc.lazy)
+	}
+}
+
+func TestFieldsPerRecord(tp *testing.T) {
+	t := testHelper{tp}
+	var cases = []struct {
+		fields int
+		err    error
+	}{
+		{0, &FieldCountError{Row: 3, Expected: 2, Actual: 1}},
+		{2, &FieldCountError{Row: 3, Expected: 2, Actual: 1}},
+		{3, &FieldCountError{Row: 1, Expected: 3, Actual: 2}},
+		{-1, nil},
+	}
+	for _, tc := range cases {
+		p := str2Reader("a,b\nc,d\ne\nf,g\n")
+		p.Config.FieldsPerRecord = tc.fields
+		rows, e := p.ReadAll()
+		if tc.err == nil {
+			t.checkNoErr(e)
+			t.checkEq(len(rows), 4)
+		} else {
+			t.checkEq(e, tc.err)
+			t.checkEq(rows, [][]string(nil))
+		}
+	}
+}
+
+func TestRuneDelim(tp *testing.T) {
+	t := testHelper{tp}
+	config := DefaultConfig()
+	config.FieldDelimRune = '§'
+	// '¦' shares its lead byte with '§'.
+	in := "a§b¦c§\"d§e\"\n1§2§3\n"
+	p := str2Reader(in)
+	p.Config = config
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{
+		{"a", "b¦c", "d§e"},
+		{"1", "2", "3"}})
+
+	out := bytes.NewBuffer(nil)
+	w := NewWriter(out)
+	w.Config = config
+	t.checkNoErr(w.WriteAll(rows))
+	t.checkEq(out.String(), in)
+}
+
+func TestStringDelim(tp *testing.T) {
+	t := testHelper{tp}
+	config := DefaultConfig()
+	config.FieldDelimString = "||"
+	in := "a||b||c\na|b||\"x||y\"||\n1||2||"
+	p := str2Reader(in)
+	p.Config = config
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{
+		{"a", "b", "c"},
+		{"a|b", "x||y", ""},
+		{"1", "2", ""}})
+
+	out := bytes.NewBuffer(nil)
+	w := NewWriter(out)
+	w.Config = config
+	t.checkNoErr(w.WriteAll(rows))
+	t.checkEq(out.String(), "a||b||c\na|b||\"x||y\"||\n1||2||\n")
+
+	out.Reset()
+	t.checkNoErr(w.WriteRow([]string{"a|", "b"}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "\"a|\"||b\n")
+}
+
+func TestRecordDelim(tp *testing.T) {
+	t := testHelper{tp}
+	var cases = []struct {
+		in    string
+		delim byte
+		nul   bool
+	}{
+		{"a,b\nc,\"d\"\n", '\n', false},
+		{"a,b\nc,\"d\"\n", 0, false},
+		{"a,b;c,\"d\";", ';', false},
+		{"a,b\x00c,\"d\"\x00", 0, true},
+	}
+	for _, tc := range cases {
+		p := str2Reader(tc.in)
+		p.Config.RecordDelim, p.Config.RecordDelimNUL = tc.delim, tc.nul
+		rows, e := p.ReadAll()
+		t.checkNoErr(e)
+		t.checkEq(rows, [][]string{{"a", "b"}, {"c", "d"}})
+	}
+
+	p := str2Reader("a\nb,c\r\n;d,e;")
+	p.Config.RecordDelim = ';'
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a\nb", "c\r\n"}, {"d", "e"}})
+
+	p = NewReader(strings.NewReader("a;b\nc\n"))
+	p.Config = Config{FieldDelim: ';', TrimSpaces: true, FieldsPerRecord: -1}
+	rows, e = p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a", "b"}, {"c"}})
+}
+
+func TestSkipBlankLines(tp *testing.T) {
+	t := testHelper{tp}
+	var cases = []struct {
+		in       string
+		trim     bool
+		expected [][]string
+	}{
+		{"a,b\n\n\r\nc,d\n\n", false, [][]string{{"a", "b"}, {"c", "d"}}},
+		{"a\n  \n\"\"\n", false, [][]string{{"a"}, {"  "}, {""}}},
+		{"a\n  \n\"\"\n", true, [][]string{{"a"}, {""}}},
+		{"\n\n\r\n", false, [][]string{}},
+	}
+	for _, tc := range cases {
+		p := str2Reader(tc.in)
+		p.Config.SkipBlankLines = true
+		p.Config.TrimSpaces = tc.trim
+		rows, e := p.ReadAll()
+		t.checkNoErr(e)
+		t.checkEq(rows, tc.expected)
+	}
+
+	rows, e := ReadAll(strings.NewReader("a\n\nb"))
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a"}, {""}, {"b"}})
+}
+
+func TestBOM(tp *testing.T) {
+	t := testHelper{tp}
+	var cases = []struct {
+		in       string
+		expected [][]string
+	}{
+		{"\xEF\xBB\xBFa,b\n\xEF\xBB\xBFc,d\n", [][]string{{"a", "b"}, {"\xEF\xBB\xBFc", "d"}}},
+		{"\xEF\xBB\xBF\"a\",b", [][]string{{"a", "b"}}},
+		{"\xEF\xBBa", [][]string{{"\xEF\xBBa"}}},
+		{"\xEF\xBB\xBF", [][]string{}},
+	}
+	for _, tc := range cases {
+		rows, e := ReadAll(strings.NewReader(tc.in))
+		t.checkNoErr(e)
+		t.checkEq(rows, tc.expected)
+	}
+}
+
+func TestCROnly(tp *testing.T) {
+	t := testHelper{tp}
+	str := "a,b\rc,\"d\"\r\"e\rf\",g\r\nh,i\nj,k\r"
+	rows, e := ReadAll(strings.NewReader(str))
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{
+		{"a", "b"},
+		{"c", "d"},
+		{"e\rf", "g"},
+		{"h", "i"},
+		{"j", "k"}})
+
+	p := str2Reader("#x\ra\r")
+	p.Config.Comment = '#'
+	rows, e = p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a"}})
+}
+
+func TestEscape(tp *testing.T) {
+	t := testHelper{tp}
+	var cases = []struct {
+		in       string
+		trim     bool
+		expected []string
+	}{
+		{`a\,b,c`, false, []string{"a,b", "c"}},
+		{`\"a\",\\`, false, []string{`"a"`, `\`}},
+		{`a\nb\tc\rd,e`, false, []string{"a\nb\tc\rd", "e"}},
+		{`"x\"y",z`, false, []string{`x"y`, "z"}},
+		{`"x\,\ny"`, false, []string{"x,\ny"}},
+		{` a\ , b `, true, []string{"a ", "b"}},
+		{`\ a`, true, []string{" a"}},
+	}
+	for _, tc := range cases {
+		p := str2Reader(tc.in)
+		p.Config.Escape = '\\'
+		p.Config.TrimSpaces = tc.trim
+		r, e := p.ReadRow()
+		t.checkNoErr(e)
+		t.checkEq(r, tc.expected)
+	}
+
+	for _, in := range []string{`a,b\`, `"a\`} {
+		p := str2Reader(in)
+		p.Config.Escape = '\\'
+		_, e := p.ReadRow()
+		t.checkEq(errors.Is(e, ErrTrailingEscape), true)
+	}
+
+	// the Writer escapes Escape, quoted or not
+	rows := [][]string{{`a\b`, `c,d\`, `"e\"`}}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.Escape = '\\'
+	t.checkNoErr(w.WriteAll(rows))
+	t.checkEq(out.String(), `a\\b,"c,d\\","""e\\"""`+"\n")
+	p := NewReader(&out)
+	p.Config.Escape = '\\'
+	read, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(read, rows)
+
+	out.Reset()
+	w.Reset(&out)
+	t.checkNoErr(w.BeginRow())
+	t.checkNoErr(w.WriteCellFrom(strings.NewReader(`f\"`)))
+	t.checkNoErr(w.EndRow())
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), `"f\\"""`+"\n")
+}
+
+func TestTrimCutset(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("\t\u00a0a b\u00a0 ,\" \tq\t \",\u00a0\u00e9\u00a0\t\n\t\tc\t\t")
+	p.Config.TrimCutset = " \t\u00a0"
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{
+		{"a b", " \tq\t ", "\u00e9"},
+		{"c"}})
+
+	p = str2Reader("\t\t,b ")
+	p.Config.FieldDelim = '\t'
+	p.Config.TrimCutset = " \t"
+	r, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"", "", ",b"})
+
+	var cases = []struct {
+		in     string
+		config Config
+	}{
+		{"a\t\tc", Config{FieldDelimRune: '\t', TrimCutset: " \t"}},
+		{"a\u00a0\u00a0c", Config{FieldDelimRune: '\u00a0', TrimCutset: " \u00a0"}},
+		{"a| | |c", Config{FieldDelimString: "| ", TrimCutset: " |"}},
+	}
+	for _, tc := range cases {
+		p = str2Reader(tc.in)
+		p.Config = tc.config
+		p.Config.FieldsPerRecord = -1
+		r, e = p.ReadRow()
+		t.checkNoErr(e)
+		t.checkEq(r, []string{"a", "", "c"})
+	}
+}
+
+func TestTrimQuoted(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("\" 42 \",\"\t yes  no\n\",\" x \" ")
+	p.Config.TrimQuoted = true
+	r, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"42", "yes  no", "x"})
+
+	p = str2Reader("\"_ a _\",\" b \"")
+	p.Config.TrimQuoted = true
+	p.Config.TrimCutset = "_"
+	r, e = p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{" a ", " b "})
+}
+
+func TestStrict(tp *testing.T) {
+	t := testHelper{tp}
+	var cases = []struct {
+		in  string
+		err error
+	}{
+		{"a,b\r\nc,\"d\"\ne,\"f\r\ng\"", nil},
+		{"a,b\nc,d\"e", &ParseError{2, 4, ErrBareQuote}},
+		{"a,\"b\" ,c", &ParseError{1, 6, ErrQuote}},
+		{"a,\"b\"x", &ParseError{1, 6, ErrQuote}},
+		{"a,b\rc,d", &ParseError{1, 4, ErrBareCR}},
+		{"a,b\nc", &FieldCountError{Row: 2, Expected: 2, Actual: 1}},
+	}
+	for _, tc := range cases {
+		p := str2Reader(tc.in)
+		p.Config.Strict = true
+		_, e := p.ReadAll()
+		t.checkEq(e, tc.err)
+	}
+}
+
+func TestMaxFieldSize(tp *testing.T) {
+	t := testHelper{tp}
+	var cases = []struct {
+		in  string
+		err error
+	}{
+		{"abcd,\"ef\"\"\"\n", nil},
+		{"a,b\nc,abcde\n", &FieldSizeError{Row: 2, Field: 1, Limit: 4}},
+		{"a,\"" + strings.Repeat("x", 1000), &FieldSizeError{Row: 1, Field: 1, Limit: 4}},
+	}
+	for _, tc := range cases {
+		p := str2Reader(tc.in)
+		p.Config.MaxFieldSize = 4
+		rows, e := p.ReadAll()
+		t.checkEq(e, tc.err)
+		if e == nil {
+			t.checkEq(rows, [][]string{{"abcd", `ef"`}})
+		}
+		t.checkThat(p.tmpbuf.Cap() < 1000, Equals(true))
+	}
+}
+
+func TestMaxColumns(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("a,b,c\nd,e,f,g\n")
+	p.Config.MaxColumns = 3
+	r, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"a", "b", "c"})
+	r, e = p.ReadRow()
+	t.checkEq(e, &ColumnLimitError{Row: 2, Limit: 3})
+	t.checkEq(r, []string(nil))
+
+	p = str2Reader(strings.Repeat("x,", 1000000))
+	p.Config.MaxColumns = 10
+	_, e = p.ReadAll()
+	t.checkEq(e, &ColumnLimitError{Row: 1, Limit: 10})
+}
+
+func TestReadN(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("a\nb\nc\nd\ne\n")
+	rows, e := p.ReadN(-1)
+	t.checkNoErr(e)
+	t.checkEq(len(rows), 0)
+	rows, e = p.ReadN(2)
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a"}, {"b"}})
+	rows, e = p.ReadN(2)
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"c"}, {"d"}})
+	rows, e = p.ReadN(2)
+	t.checkEq(e, io.EOF)
+	t.checkEq(rows, [][]string{{"e"}})
+	rows, e = p.ReadN(2)
+	t.checkEq(e, io.EOF)
+	t.checkEq(len(rows), 0)
+}
+
+func TestMaxRows(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("a\nb\nc\n")
+	p.Config.MaxRows = 2
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a"}, {"b"}})
+
+	p = str2Reader("a\n")
+	p.Config.MaxRows = 2
+	rows, e = p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a"}})
+}
+
+func TestReadRowPtr(tp *testing.T) {
+	t := testHelper{tp}
+	ptr := func(s string) *string { return &s }
+	var cases = []struct {
+		in       string
+		escape   byte
+		expected []*string
+	}{
+		{`a,\N,"\N",,\Nx`, 0, []*string{ptr("a"), nil, ptr(`\N`), ptr(""), ptr(`\Nx`)}},
+		{`a,\N, \N ,"\N",\\N`, '\\', []*string{ptr("a"), nil, nil, ptr("N"), ptr(`\N`)}},
+		{`\N,`, 0, []*string{nil, ptr("")}},
+	}
+	for _, tc := range cases {
+		p := str2Reader(tc.in)
+		p.Config.NullString = `\N`
+		p.Config.Escape = tc.escape
+		p.Config.TrimSpaces = true
+		r, e := p.ReadRowPtr()
+		t.checkNoErr(e)
+		t.checkEq(r, tc.expected)
+	}
+}
+
+func TestSkipLines(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("\xEF\xBB\xBFAccount: \"12,34\r\nFrom 2024\ra,b\nc,d\n")
+	p.Config.SkipLines = 2
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a", "b"}, {"c", "d"}})
+
+	p = str2Reader("one\ntwo")
+	p.Config.SkipLines = 5
+	r, e := p.ReadRow()
+	t.checkEq(e, io.EOF)
+	t.checkEq(r, []string(nil))
+}
+
+func TestStopAtPrefix(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("a,b\nc,d\nEND-OF-REPORT,rowcount=2\n\"junk")
+	p.Config.StopAtPrefix = "END-OF-REPORT"
+	p.Config.FieldsPerRecord = 0
+	t.checkEq(p.Footer(), []string(nil))
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a", "b"}, {"c", "d"}})
+	t.checkEq(p.Footer(), []string{"END-OF-REPORT", "rowcount=2"})
+	r, e := p.ReadRow()
+	t.checkEq(e, io.EOF)
+	t.checkEq(r, []string(nil))
+}
+
+func TestInlineComment(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("value1,value2  # human note\n\"a#b\" # x,y\nc,d#\ne#")
+	p.Config.InlineComment = '#'
+	p.Config.TrimSpaces = true
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{
+		{"value1", "value2"},
+		{"a#b"},
+		{"c", "d"},
+		{"e"}})
+
+	p = str2Reader("a,b")
+	p.Config.InlineComment = ','
+	_, e = p.ReadRow()
+	t.checkEq(e, &ConfigError{"InlineComment", "must differ from FieldDelim and QuoteChar"})
+}
+
+func TestCollapseDelims(tp *testing.T) {
+	t := testHelper{tp}
+	str := "  PID TTY      CMD\n    1 ?        \"init  process\"  \n\n   42 pts/0    bash"
+	p := str2Reader(str)
+	p.Config.FieldDelim = ' '
+	p.Config.CollapseDelims = true
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{
+		{"PID", "TTY", "CMD"},
+		{"1", "?", "init  process"},
+		{""},
+		{"42", "pts/0", "bash"}})
+
+	p = str2Reader(",,a,,,b,,")
+	p.Config.CollapseDelims = true
+	r, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"a", "b"})
+
+	for _, collapse := range []bool{false, true} {
+		p = str2Reader(`a "b c" d`)
+		p.Config.FieldDelim = ' '
+		p.Config.CollapseDelims = collapse
+		r, e = p.ReadRow()
+		t.checkNoErr(e)
+		t.checkEq(r, []string{"a", "b c", "d"})
+	}
+}
+
+func TestValidate(tp *testing.T) {
+	t := testHelper{tp}
+	var cases = []struct {
+		change func(*Config)
+		field  string
+	}{
+		{func(c *Config) {}, ""},
+		{func(c *Config) { c.FieldDelim = '\t'; c.TrimSpaces = true }, ""},
+		{func(c *Config) { c.FieldDelim = '"' }, "FieldDelim"},
+		{func(c *Config) { c.FieldDelim = '\n' }, "FieldDelim"},
+		{func(c *Config) { c.FieldDelim = '\r' }, "FieldDelim"},
+		{func(c *Config) { c.FieldDelim = 0 }, "FieldDelim"},
+		{func(c *Config) { c.FieldDelimRune = 0xD800 }, "FieldDelimRune"},
+		{func(c *Config) { c.FieldDelimString = "|\"|" }, "FieldDelimString"},
+		{func(c *Config) { c.QuoteChar = '\''; c.FieldDelim = '\'' }, "FieldDelim"},
+		{func(c *Config) { c.RecordDelim = ';'; c.FieldDelim = ';' }, "FieldDelim"},
+		{func(c *Config) { c.Comment = ',' }, "Comment"},
+		{func(c *Config) { c.Escape = '"' }, "Escape"},
+		{func(c *Config) { c.LazyQuotes = true; c.Strict = true }, "LazyQuotes"},
+		{func(c *Config) { c.PreferEscape = true }, "PreferEscape"},
+		{func(c *Config) { c.EscapeNewlines = true; c.Escape = '\\' }, "EscapeNewlines"},
+		{func(c *Config) { c.RecordDelimOut = "," }, "RecordDelimOut"},
+	}
+	for _, tc := range cases {
+		c := DefaultConfig()
+		tc.change(&c)
+		e := c.Validate()
+		if tc.field == "" {
+			t.checkNoErr(e)
+			continue
+		}
+		var ce *ConfigError
+		if t.checkEq(errors.As(e, &ce), true) {
+			t.checkEq(ce.Field, tc.field)
+		}
+
+		p := str2Reader("a")
+		p.Config = c
+		_, e = p.ReadRow()
+		t.checkEq(e, c.Validate())
+
+		w := NewWriter(bytes.NewBuffer(nil))
+		w.Config = c
+		t.checkEq(w.WriteRow([]string{"a"}), c.Validate())
+	}
+}
+
+func TestSepDirective(tp *testing.T) {
+	t := testHelper{tp}
+	var cases = []struct {
+		in       string
+		expected [][]string
+	}{
+		{"sep=;\r\na;b,c\n", [][]string{{"a", "b,c"}}},
+		{"\xEF\xBB\xBFsep=|\na|b\n", [][]string{{"a", "b"}}},
+		{"sep=§\na§b", [][]string{{"a", "b"}}},
+		{"sep=;", [][]string{}},
+		{"sep=;;\na,b", [][]string{{"sep=;;"}, {"a", "b"}}},
+		{"sep\na,b", [][]string{{"sep"}, {"a", "b"}}},
+		{"a,b\nsep=;\n", [][]string{{"a", "b"}, {"sep=;"}}},
+	}
+	for _, tc := range cases {
+		p := str2Reader(tc.in)
+		p.Config.HonorSepDirective = true
+		rows, e := p.ReadAll()
+		t.checkNoErr(e)
+		t.checkEq(rows, tc.expected)
+	}
+
+	// the line ending is left intact when there is no directive
+	p := str2Reader("sep=;;\r\na")
+	p.Config.HonorSepDirective = true
+	p.Config.Strict = true
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"sep=;;"}, {"a"}})
+}
+
+func TestDetectConfig(tp *testing.T) {
+	t := testHelper{tp}
+	var cases = []struct {
+		in    string
+		delim byte
+		trim  bool
+	}{
+		{"a,b,c\n1,2,3\n", ',', false},
+		{"a;b;c\r\n1,5;2,5;3\r\n", ';', false},
+		{"a\tb\n\"x,y,z\"\t2\n", '\t', false},
+		{"a|b|c\n1|\"2|3\"|4\n", '|', false},
+		{"name, age, city\nbob, 42, \"Paris, FR\"\n", ',', true},
+		{"single\ncolumn\n", ',', false},
+	}
+	for _, tc := range cases {
+		config, r, e := DetectConfig(strings.NewReader(tc.in), 1024)
+		t.checkNoErr(e)
+		t.checkEq(config.FieldDelim, tc.delim)
+		t.checkEq(config.TrimSpaces, tc.trim)
+		all, e := io.ReadAll(r)
+		t.checkNoErr(e)
+		t.checkEq(string(all), tc.in)
+	}
+
+	// a short sample is replayed ahead of the rest of the input
+	in := "a;b\n1;2\n3;4\n" + strings.Repeat("5;6\n", 100)
+	config, r, e := DetectConfig(strings.NewReader(in), 12)
+	t.checkNoErr(e)
+	t.checkEq(config.FieldDelim, byte(';'))
+	p := NewReader(bufio.NewReader(r))
+	p.Config = config
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(len(rows), 103)
+
+	_, _, e = DetectConfig(strings.NewReader(in), -1)
+	t.checkEq(e, ErrSampleSize)
+}
+
+func TestNewReaderConfig(tp *testing.T) {
+	t := testHelper{tp}
+	config := DefaultConfig()
+	config.FieldDelim = ';'
+	p, e := NewReaderConfig(strings.NewReader("a;b\n"), config)
+	t.checkNoErr(e)
+	r, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"a", "b"})
+
+	config.FieldDelim = '"'
+	p, e = NewReaderConfig(strings.NewReader("a;b\n"), config)
+	t.checkEq(e, &ConfigError{"FieldDelim", "must not contain QuoteChar"})
+	t.checkEq(p, (*Reader)(nil))
+}
+
+func TestReaderReset(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("sep=;\na;b\n\"unterminated")
+	p.Config.HonorSepDirective = true
+	p.Config.FieldsPerRecord = 0
+	p.Config.StopAtPrefix = "END"
+	r, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"a", "b"})
+	_, e = p.ReadRow()
+	t.checkEq(e, io.ErrUnexpectedEOF)
+
+	p.Reset(strings.NewReader("x,y,z\n1,2,3\nEND\n"))
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"x", "y", "z"}, {"1", "2", "3"}})
+	t.checkEq(p.Footer(), []string{"END"})
+
+	p.Reset(strings.NewReader("sep=|\na|b"))
+	rows, e = p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a", "b"}})
+	t.checkEq(p.Footer(), []string(nil))
+}
+
+func TestNewReaderSources(tp *testing.T) {
+	t := testHelper{tp}
+	p := NewReader(iotest.OneByteReader(strings.NewReader("a,b\nc,d\n")))
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a", "b"}, {"c", "d"}})
+	buf := p.buf
+
+	p.Reset(iotest.HalfReader(strings.NewReader("e,f\n")))
+	rows, e = p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"e", "f"}})
+	t.checkEq(p.buf, buf)
+
+	br := bufio.NewReader(strings.NewReader("g,h"))
+	p = NewUnbufferedReader(br)
+	t.checkEq(p.br, io.ByteReader(br))
+	rows, e = p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"g", "h"}})
+}
+
+func TestPadRows(tp *testing.T) {
+	t := testHelper{tp}
+	var cases = []struct {
+		fields   int
+		in       string
+		expected [][]string
+		err      error
+	}{
+		{-1, "a,b,c\nd\ne,f\n", [][]string{{"a", "b", "c"}, {"d", "", ""}, {"e", "f", ""}}, nil},
+		{0, "a,b,c\nd\n", [][]string{{"a", "b", "c"}, {"d", "", ""}}, nil},
+		{4, "a,b,c\nd\n", [][]string{{"a", "b", "c", ""}, {"d", "", "", ""}}, nil},
+		{2, "a,b\nc,d,e\n", nil, &FieldCountError{Row: 2, Expected: 2, Actual: 3}},
+	}
+	for _, tc := range cases {
+		p := str2Reader(tc.in)
+		p.Config.FieldsPerRecord = tc.fields
+		p.Config.PadRows = true
+		rows, e := p.ReadAll()
+		t.checkEq(e, tc.err)
+		t.checkEq(rows, tc.expected)
+	}
+}
+
+func TestTruncateRows(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("a,b\nc,d,note,more\ne\n")
+	p.Config.FieldsPerRecord = 2
+	p.Config.TruncateRows = true
+	var tails [][]string
+	p.SetTruncateFunc(func(row int, tail []string) {
+		t.checkEq(row, 2)
+		tails = append(tails, tail)
+	})
+	r, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"a", "b"})
+	r, e = p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"c", "d"})
+	t.checkEq(tails, [][]string{{"note", "more"}})
+	_, e = p.ReadRow()
+	t.checkEq(e, &FieldCountError{Row: 3, Expected: 2, Actual: 1})
+
+	p = str2Reader("a,b,c,d,e,f\ng,h,i\n")
+	p.Config.FieldsPerRecord = 2
+	p.Config.TruncateRows = true
+	p.Config.MaxColumns = 3
+	tails = nil
+	p.SetTruncateFunc(func(row int, tail []string) {
+		tails = append(tails, tail)
+	})
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a", "b"}, {"g", "h"}})
+	t.checkEq(tails, [][]string{{"c"}, {"i"}})
+
+	// MaxColumns caps the width rows are truncated to
+	for _, fields := range []int{-1, 0, 2, 4} {
+		p = str2Reader("a,b,c,d\ne,f,g,h\n")
+		p.Config.FieldsPerRecord = fields
+		p.Config.TruncateRows = true
+		p.Config.MaxColumns = 2
+		rows, e = p.ReadAll()
+		t.checkNoErr(e)
+		t.checkEq(rows, [][]string{{"a", "b"}, {"e", "f"}})
+	}
+}
+
+func TestNormalizeQuotedNewlines(tp *testing.T) {
+	t := testHelper{tp}
+	str := "\"line1\r\n\"\"quoted\"\"\r\nline3\",\"a\rb\r\"\r\nc\rd\n"
+	p := str2Reader(str)
+	p.Config.NormalizeQuotedNewlines = true
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{
+		{"line1\n\"quoted\"\nline3", "a\nb\n"},
+		{"c"},
+		{"d"}})
+
+	rows, e = ReadAll(strings.NewReader(str))
+	t.checkNoErr(e)
+	t.checkEq(rows[0], []string{"line1\r\n\"quoted\"\r\nline3", "a\rb\r"})
+}
+
+func TestReadRowMeta(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("123,\"123\",,\"\",\\N\nx")
+	p.Config.NullString = `\N`
+	p.Config.FieldsPerRecord = 6
+	p.Config.PadRows = true
+	r, e := p.ReadRowMeta()
+	t.checkNoErr(e)
+	t.checkEq(r, []Cell{
+		{"123", false, false},
+		{"123", true, false},
+		{"", false, false},
+		{"", true, false},
+		{`\N`, false, true},
+		{"", false, false}})
+	r, e = p.ReadRowMeta()
+	t.checkNoErr(e)
+	t.checkEq(len(r), 6)
+	t.checkEq(r[0], Cell{Value: "x"})
+}
+
+func TestRowFilter(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("id,status\n1, ok\nid,status\n2,VOID\n3\n4,x,y\n")
+	p.Config.TrimSpaces = true
+	p.Config.FieldsPerRecord = 2
+	p.Config.PadRows = true
+	p.SetRowFilter(func(row []string) bool {
+		return row[0] != "id" && row[1] != "VOID"
+	})
+	r, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"1", "ok"})
+	r, e = p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"3", ""})
+	_, e = p.ReadRow()
+	t.checkEq(e, &FieldCountError{Row: 6, Expected: 2, Actual: 3})
+}
+
+type closeCounter struct {
+	io.Reader
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed += 1
+	return nil
+}
+
+func TestClose(tp *testing.T) {
+	t := testHelper{tp}
+	rc := &closeCounter{Reader: strings.NewReader("a,b\n")}
+	p := NewReader(rc)
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a", "b"}})
+	t.checkNoErr(p.Close())
+	t.checkNoErr(p.Close())
+	t.checkEq(rc.closed, 1)
+
+	t.checkNoErr(str2Reader("a").Close())
+
+	rc = &closeCounter{Reader: strings.NewReader("a,b\n\"c")}
+	rows, e = ReadAllClose(rc)
+	t.checkEq(e, io.ErrUnexpectedEOF)
+	t.checkEq(rows, [][]string(nil))
+	t.checkEq(rc.closed, 1)
+}
+
+func TestDisallowQuotedNewlines(tp *testing.T) {
+	t := testHelper{tp}
+	var cases = []struct {
+		in  string
+		err error
+	}{
+		{"a,\"b\"\r\n\"c,d\"\n", nil},
+		{"a,b\nc,\"d\ne\"\n", &ParseError{2, 5, ErrQuotedNewline}},
+		{"\"a\rb\"", &ParseError{1, 3, ErrQuotedNewline}},
+	}
+	for _, tc := range cases {
+		p := str2Reader(tc.in)
+		p.Config.DisallowQuotedNewlines = true
+		_, e := p.ReadAll()
+		t.checkEq(e, tc.err)
+	}
+}
+
+func TestBOM16(tp *testing.T) {
+	t := testHelper{tp}
+	// ',' (0x2C) is also the low byte of U+012C
+	text := "a,\u012c\n\"\U0001F600,\",\u00e9\r\n"
+	units := utf16.Encode([]rune(text))
+	le := []byte{0xFF, 0xFE}
+	be := []byte{0xFE, 0xFF}
+	for _, u := range units {
+		le = append(le, byte(u), byte(u>>8))
+		be = append(be, byte(u>>8), byte(u))
+	}
+	for _, in := range [][]byte{le, be} {
+		rows, e := ReadAll(bytes.NewReader(in))
+		t.checkNoErr(e)
+		t.checkEq(rows, [][]string{{"a", "\u012c"}, {"\U0001F600,", "\u00e9"}})
+	}
+
+	// an unpaired surrogate doesn't swallow the next character
+	rows, e := ReadAll(bytes.NewReader([]byte{0xFF, 0xFE, 0x00, 0xD8, 'a', 0, ',', 0, 'b', 0}))
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"\uFFFDa", "b"}})
+
+	_, e = ReadAll(bytes.NewReader([]byte{0xFF, 0xFE, 'a', 0, 'b'}))
+	t.checkEq(e, io.ErrUnexpectedEOF)
+}
+
+func TestFallbackWindows1252(tp *testing.T) {
+	t := testHelper{tp}
+	// 0x92 is a smart quote in Windows-1252 and invalid in UTF-8,
+	// while "\xc3\xa9" is valid UTF-8 and left alone
+	p := str2Reader("it\x92s,caf\xe9,caf\xc3\xa9,\x80\x81\xff\n")
+	p.Config.FallbackWindows1252 = true
+	r, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"it\u2019s", "caf\u00e9", "caf\u00e9", "\u20ac\u0081\u00ff"})
+
+	r, e = str2Reader("it\x92s").ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"it\x92s"})
+}
+
+func TestValidateUTF8(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("caf\u00e9,\U0001F600\na,\"b\u00e9\xe9x\"\n")
+	p.Config.ValidateUTF8 = true
+	r, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"caf\u00e9", "\U0001F600"})
+	r, e = p.ReadRow()
+	t.checkEq(e, &UTF8Error{Row: 2, Field: 1, Offset: 3})
+	t.checkEq(r, []string(nil))
+
+	p = str2Reader("caf\xe9")
+	p.Config.ValidateUTF8 = true
+	p.Config.FallbackWindows1252 = true
+	r, e = p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"caf\u00e9"})
+}
+
+func TestMaxBytes(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("a,b\nc,d\ne,f\n")
+	p.Config.MaxBytes = 6
+	r, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(r, []string{"a", "b"})
+	_, e = p.ReadRow()
+	t.checkEq(e, &InputSizeError{Limit: 6, Consumed: 7})
+	t.checkEq(errors.Is(e, ErrInputTooLarge), true)
+	_, e = p.ReadRow()
+	t.checkEq(errors.Is(e, ErrInputTooLarge), true)
+
+	p = str2Reader("a,b\n")
+	p.Config.MaxBytes = 4
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a", "b"}})
+}
+
+func TestResume(tp *testing.T) {
+	t := testHelper{tp}
+	in := "a,b\n\"c\nc\",d\ne,f\ng\n"
+	p := str2Reader(in)
+	offset, rows := p.Checkpoint()
+	t.checkEq(offset, int64(0))
+	t.checkEq(rows, 0)
+	_, e := p.ReadN(2)
+	t.checkNoErr(e)
+	offset, rows = p.Checkpoint()
+	t.checkEq(offset, int64(12))
+	t.checkEq(rows, 2)
+	pos := p.Position()
+	t.checkEq(pos, ReadPosition{Offset: 12, Rows: 2, Lines: 3})
+
+	p = NewReader(strings.NewReader(""))
+	p.Config.FieldsPerRecord = 2
+	t.checkNoErr(p.Resume(strings.NewReader(in), pos))
+	row, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(row, []string{"e", "f"})
+	_, e = p.ReadRow()
+	t.checkEq(e, &FieldCountError{4, 2, 1})
+	offset, rows = p.Checkpoint()
+	t.checkEq(offset, int64(16))
+	t.checkEq(rows, 3)
+
+	// line numbers in errors count from the start of the input
+	in = "a,b\nc,d\ne,\"f\"x\n"
+	p = str2Reader(in)
+	_, e = p.ReadRow()
+	t.checkNoErr(e)
+	pos = p.Position()
+	p = NewReader(strings.NewReader(""))
+	t.checkNoErr(p.Resume(strings.NewReader(in), pos))
+	_, e = p.ReadRow()
+	t.checkNoErr(e)
+	_, e = p.ReadRow()
+	t.checkEq(e, &ParseError{Line: 3, Column: 6, Err: ErrQuote})
+
+	// a delimiter set by sep= is used again
+	in = "sep=;\na;b\nc;d\n"
+	p = str2Reader(in)
+	p.Config.HonorSepDirective = true
+	_, e = p.ReadRow()
+	t.checkNoErr(e)
+	pos = p.Position()
+	p = NewReader(strings.NewReader(""))
+	p.Config.HonorSepDirective = true
+	t.checkNoErr(p.Resume(strings.NewReader(in), pos))
+	row, e = p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(row, []string{"c", "d"})
+}
+
+func TestEmptyUnquotedAs(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("a,,\"\"\n,\n")
+	p.Config.EmptyUnquotedAs = "<missing>"
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a", "<missing>", ""}, {"<missing>", "<missing>"}})
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Config.EmptyUnquotedAs = "<missing>"
+	t.checkNoErr(w.WriteAll(rows))
+	t.checkEq(buf.String(), "a,,\"\"\n,\n")
+}
+
+func TestSkip(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("a,b\n\"c\nc\",d\n# x\ne,f\ng\n")
+	p.Config.Comment = '#'
+	n, e := p.Skip(2)
+	t.checkNoErr(e)
+	t.checkEq(n, 2)
+	row, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(row, []string{"e", "f"})
+	n, e = p.Skip(3)
+	t.checkEq(e, io.EOF)
+	t.checkEq(n, 1)
+
+	p = str2Reader("a\nb,\"c\n")
+	n, e = p.Skip(2)
+	t.checkEq(e, io.ErrUnexpectedEOF)
+	t.checkEq(n, 1)
+}
+
+func TestRowScanner(tp *testing.T) {
+	t := testHelper{tp}
+	s := NewRowScanner(strings.NewReader("a;b\nc;d"))
+	s.Reader().Config.FieldDelim = ';'
+	var rows [][]string
+	for s.Scan() {
+		rows = append(rows, s.Row())
+	}
+	t.checkNoErr(s.Err())
+	t.checkEq(rows, [][]string{{"a", "b"}, {"c", "d"}})
+	t.checkEq(s.Scan(), false)
+
+	s = str2Reader("a\n\"b").Scanner()
+	t.checkEq(s.Scan(), true)
+	t.checkEq(s.Row(), []string{"a"})
+	t.checkEq(s.Scan(), false)
+	t.checkEq(s.Err(), io.ErrUnexpectedEOF)
+}
+
+func TestRows(tp *testing.T) {
+	t := testHelper{tp}
+	var rows [][]string
+	for row, e := range Rows(strings.NewReader("a,b\nc,d\n")) {
+		t.checkNoErr(e)
+		rows = append(rows, row)
+	}
+	t.checkEq(rows, [][]string{{"a", "b"}, {"c", "d"}})
+
+	p := str2Reader("a\nb\n\"c")
+	for row, e := range p.Rows() {
+		t.checkNoErr(e)
+		t.checkEq(row, []string{"a"})
+		break
+	}
+	var errs []error
+	for _, e := range p.Rows() {
+		errs = append(errs, e)
+	}
+	t.checkEq(errs, []error{nil, io.ErrUnexpectedEOF})
+}
+
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestWriterFlush(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	t.checkNoErr(w.WriteRow([]string{"a", "b"}))
+	t.checkEq(out.String(), "")
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "a,b\n")
+	t.checkNoErr(w.Error())
+
+	w = NewWriter(failWriter{})
+	t.checkNoErr(w.WriteRow([]string{"a"}))
+	t.checkEq(w.Flush(), io.ErrClosedPipe)
+	t.checkEq(w.Error(), io.ErrClosedPipe)
+	t.checkEq(w.WriteAll([][]string{{"b"}}), io.ErrClosedPipe)
+}
+
+func TestQuoting(tp *testing.T) {
+	t := testHelper{tp}
+	rows := [][]string{{"a", "1", "-2.5e3", ""}, {"1.", ".5", "1e", "b c"}}
+	for _, c := range []struct {
+		mode     Quoting
+		expected string
+	}{
+		{QuoteMinimal, "a,1,-2.5e3,\n1.,.5,1e,b c\n"},
+		{QuoteAll, `"a","1","-2.5e3",""` + "\n" + `"1.",".5","1e","b c"` + "\n"},
+		{QuoteNonNumeric, `"a",1,-2.5e3,""` + "\n" + `1.,.5,"1e","b c"` + "\n"},
+	} {
+		var out bytes.Buffer
+		w := NewWriter(&out)
+		w.Config.Quoting = c.mode
+		t.checkNoErr(w.WriteAll(rows))
+		t.checkEq(out.String(), c.expected)
+	}
+
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.Quoting = QuoteNever
+	t.checkNoErr(w.WriteRow([]string{"a", "b c"}))
+	t.checkEq(w.WriteRow([]string{"a", "b,c"}), &QuoteError{2, 1, "b,c"})
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "a,b c\n")
+}
+
+func TestUseCRLF(tp *testing.T) {
+	t := testHelper{tp}
+	in := "a,\"b\r\nc\"\r\nd,e\r\n"
+	rows, e := ReadAll(strings.NewReader(in))
+	t.checkNoErr(e)
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.UseCRLF = true
+	t.checkNoErr(w.WriteAll(rows))
+	t.checkEq(out.String(), in)
+}
+
+func TestRecordDelimOut(tp *testing.T) {
+	t := testHelper{tp}
+	rows := [][]string{{"a", "b\x00c"}, {"d", "e"}}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.RecordDelimOut = "\x00"
+	t.checkNoErr(w.WriteAll(rows))
+	t.checkEq(out.String(), "a,\"b\x00c\"\x00d,e\x00")
+
+	p := NewReader(&out)
+	p.Config.RecordDelimNUL = true
+	read, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(read, rows)
+
+	out.Reset()
+	w = NewWriter(&out)
+	w.Config.RecordDelimOut = ";"
+	t.checkNoErr(w.WriteAll([][]string{{"a;b", "c"}}))
+	t.checkEq(out.String(), "\"a;b\",c;")
+}
+
+func TestPreferEscape(tp *testing.T) {
+	t := testHelper{tp}
+	rows := [][]string{{"a,b", `c\`, `\,"`}, {"d\ne\r", " f ", "g\\n"}}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.Escape = '\\'
+	w.Config.PreferEscape = true
+	w.Config.Quoting = QuoteAll
+	t.checkNoErr(w.WriteAll(rows))
+	t.checkEq(out.String(), `a\,b,c\\,\\\,\"`+"\n"+`d\ne\r,\ f\ ,g\\n`+"\n")
+
+	p := NewReader(&out)
+	p.Config.Escape = '\\'
+	p.Config.TrimSpaces = true
+	read, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(read, rows)
+}
+
+func TestWriteRowMap(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	t.checkEq(w.WriteRowMap(map[string]string{"a": "1"}), ErrNoHeader)
+	t.checkNoErr(w.WriteHeader([]string{"a", "b", "c"}))
+	t.checkNoErr(w.WriteRowMap(map[string]string{"c": "3", "a": "1", "x": "?"}))
+	w.Config.RejectUnknownKeys = true
+	t.checkEq(w.WriteRowMap(map[string]string{"b": "2", "z": "", "y": ""}), &UnknownKeyError{3, "y"})
+	t.checkNoErr(w.WriteRowMap(map[string]string{"b": "2"}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "a,b,c\n1,,3\n,2,\n")
+}
+
+func TestWriteHeader(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.FieldsPerRecord = 0
+	t.checkNoErr(w.WriteHeader([]string{"a", "b"}))
+	t.checkEq(w.WriteHeader([]string{"a", "b"}), ErrHeaderWritten)
+	t.checkNoErr(w.WriteRow([]string{"1", "2"}))
+	t.checkEq(w.WriteRow([]string{"3"}), &FieldCountError{3, 2, 1})
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "a,b\n1,2\n")
+
+	w = NewWriter(&out)
+	t.checkNoErr(w.WriteRow([]string{"1", "2"}))
+	t.checkEq(w.WriteHeader([]string{"a", "b"}), ErrHeaderAfterRows)
+}
+
+func TestWriteRowAny(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	when := time.Date(2024, 3, 1, 12, 30, 0, 5e8, time.UTC)
+	t.checkNoErr(w.WriteRowAny("a b,c", -12, uint8(7), 1e21, float32(0.1), true, when, nil,
+		time.Minute, []int{1, 2}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), `"a b,c",-12,7,1e+21,0.1,true,2024-03-01T12:30:00.5Z,,1m0s,[1 2]`+"\n")
+}
+
+func TestWriteCR(tp *testing.T) {
+	t := testHelper{tp}
+	rows := [][]string{{"line1\rline2", "x"}}
+	var out bytes.Buffer
+	t.checkNoErr(WriteAll(&out, rows))
+	t.checkEq(out.String(), "\"line1\rline2\",x\n")
+	read, e := ReadAll(&out)
+	t.checkNoErr(e)
+	t.checkEq(read, rows)
+}
+
+func TestWriteTab(tp *testing.T) {
+	t := testHelper{tp}
+	rows := [][]string{{"a\tb", "c"}}
+	var out bytes.Buffer
+	t.checkNoErr(WriteAll(&out, rows))
+	t.checkEq(out.String(), "a\tb,c\n")
+
+	out.Reset()
+	w := NewWriter(&out)
+	w.Config.FieldDelim = '\t'
+	t.checkNoErr(w.WriteAll(rows))
+	t.checkEq(out.String(), "\"a\tb\"\tc\n")
+}
+
+func TestNewWriterSize(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	bw := bufio.NewWriterSize(&out, 1<<16)
+	w := NewWriter(bw)
+	t.checkEq(w.out, bw)
+	t.checkEq(NewWriterSize(bw, 1024).out, bw)
+	t.checkNoErr(w.WriteAll([][]string{{"a", "b"}}))
+	t.checkEq(out.String(), "a,b\n")
+
+	w = NewWriterSize(&out, 1<<20)
+	t.checkEq(w.out.Size(), 1<<20)
+	t.checkNoErr(w.WriteRow(make([]string, 1<<16)))
+	t.checkEq(out.Len(), 4)
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.Len(), 4+1<<16)
+}
+
+func TestByteCount(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.FieldDelimString = "||"
+	w.Config.UseCRLF = true
+	for _, row := range [][]string{{"a", "b"}, {"c\"d", " e"}, {""}, {"é", "x||y"}} {
+		t.checkNoErr(w.WriteRow(row))
+		t.checkNoErr(w.Flush())
+		t.checkEq(w.ByteCount(), int64(out.Len()))
+	}
+	w.Config.PreferEscape, w.Config.Escape = true, '\\'
+	t.checkNoErr(w.WriteRow([]string{"a\nb", `c\`}))
+	t.checkEq(w.ByteCount(), int64(out.Len()+11))
+}
+
+func TestSanitizeFormulas(tp *testing.T) {
+	t := testHelper{tp}
+	row := []string{"=SUM(A1)", "-42", "-2+3", "+1.5", "@x", "a=b", ""}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.SanitizeFormulas = true
+	t.checkNoErr(w.WriteAll([][]string{row}))
+	t.checkEq(out.String(), "'=SUM(A1),-42,'-2+3,+1.5,'@x,a=b,\n")
+	t.checkEq(row[0], "=SUM(A1)")
+
+	out.Reset()
+	w.Config.FormulaGuard = '\t'
+	t.checkNoErr(w.WriteAll([][]string{{"=1"}}))
+	t.checkEq(out.String(), "\t=1\n")
+}
+
+func TestWriteRowPtr(tp *testing.T) {
+	t := testHelper{tp}
+	a, empty, null := "a", "", `\N`
+	row := []*string{&a, nil, &empty, &null}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.NullString = `\N`
+	t.checkNoErr(w.WriteRowPtr(row))
+	t.checkNoErr(w.WriteRow([]string{`\N`}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), `a,\N,,"\N"`+"\n"+`\N`+"\n")
+
+	p := NewReader(&out)
+	p.Config.NullString = `\N`
+	read, e := p.ReadRowPtr()
+	t.checkNoErr(e)
+	t.checkEq(read, row)
+
+	out.Reset()
+	w = NewWriter(&out)
+	t.checkNoErr(w.WriteRowPtr([]*string{nil, &empty}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), `,""`+"\n")
+}
+
+func TestNoFinalNewline(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.NoFinalNewline = true
+	t.checkNoErr(w.WriteAll([][]string{{"a", "b"}, {"c", "d"}}))
+	t.checkEq(out.String(), "a,b\nc,d")
+	t.checkNoErr(w.WriteRow([]string{"e"}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "a,b\nc,d\ne")
+}
+
+func TestWriteAllAligned(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	t.checkNoErr(w.WriteAllAligned([][]string{
+		{"name", "city", "n"},
+		{"Zoë", "Zürich", "12"},
+		{"Bartholomew", "", "3"},
+		{"x"}}))
+	t.checkEq(out.String(), ""+
+		"name         city    n\n"+
+		"Zoë          Zürich  12\n"+
+		"Bartholomew          3\n"+
+		"x\n")
+
+	out.Reset()
+	w = NewWriter(&out)
+	w.Config.NoFinalNewline = true
+	w.Config.WriteBOM = true
+	t.checkNoErr(w.WriteRow([]string{"ab"}))
+	t.checkNoErr(w.WriteAllAligned([][]string{{"東京", "x"}, {"e\u0301", "y"}, {"abcd", "z"}}))
+	t.checkEq(out.String(), "\xEF\xBB\xBFab\n"+
+		"東京  x\n"+
+		"e\u0301     y\n"+
+		"abcd  z")
+	t.checkNoErr(w.Close())
+	t.checkEq(w.WriteAllAligned([][]string{{"a"}}), ErrWriterClosed)
+
+	w = NewWriter(&out)
+	w.Config.QuoteChar = ','
+	t.checkEq(w.WriteAllAligned([][]string{{"a"}}), w.Config.Validate())
+}
+
+func TestWriteMarkdown(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	t.checkNoErr(WriteMarkdown(&out, []string{"name", "note"}, [][]string{
+		{"a|b", "`x`"},
+		{`c\`, "d\r\ne"},
+		{"f"}}))
+	t.checkEq(out.String(), ""+
+		"| name | note |\n"+
+		"| --- | --- |\n"+
+		"| a\\|b | \\`x\\` |\n"+
+		"| c\\\\ | d<br>e |\n"+
+		"| f |  |\n")
+
+	t.checkEq(WriteMarkdown(failWriter{}, []string{"a"}, nil), io.ErrClosedPipe)
+	t.checkEq(WriteMarkdown(&out, nil, nil), ErrNoHeader)
+	out.Reset()
+	e := WriteMarkdown(&out, []string{"a"}, [][]string{{"1"}, {"2", "3"}})
+	t.checkEq(e, &FieldCountError{Row: 3, Expected: 1, Actual: 2})
+	t.checkEq(out.Len(), 0)
+}
+
+func TestWriteHTML(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	t.checkNoErr(WriteHTML(&out, []string{"a<b", "c"}, [][]string{{`"x" & 'y'`, "<i>"}}))
+	t.checkEq(out.String(), "<table>\n"+
+		"<thead>\n<tr><th>a&lt;b</th><th>c</th></tr>\n</thead>\n"+
+		"<tbody>\n<tr><td>&#34;x&#34; &amp; &#39;y&#39;</td><td>&lt;i&gt;</td></tr>\n</tbody>\n"+
+		"</table>\n")
+
+	out.Reset()
+	w := NewHTMLWriter(&out)
+	w.Class = "report"
+	t.checkNoErr(w.WriteRow([]string{"1"}))
+	t.checkEq(w.WriteHeader([]string{"n"}), ErrHeaderAfterRows)
+	t.checkNoErr(w.Close())
+	t.checkEq(out.String(), "<table class=\"report\">\n<tbody>\n<tr><td>1</td></tr>\n</tbody>\n</table>\n")
+	t.checkEq(w.WriteRow([]string{"2"}), ErrWriterClosed)
+	t.checkEq(w.WriteHeader([]string{"n"}), ErrWriterClosed)
+	t.checkNoErr(w.Close())
+	t.checkEq(out.String(), "<table class=\"report\">\n<tbody>\n<tr><td>1</td></tr>\n</tbody>\n</table>\n")
+}
+
+func TestWriteComment(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	_, ok := w.WriteComment("x").(*ConfigError)
+	t.checkEq(ok, true)
+	w.Config.Comment = '#'
+	t.checkNoErr(w.WriteComment("generated\r\n\nby test"))
+	t.checkNoErr(w.WriteRow([]string{"a", "#b"}))
+	t.checkNoErr(w.WriteComment("end"))
+	t.checkNoErr(w.WriteRow([]string{"#c"}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "# generated\n#\n# by test\na,#b\n# end\n\"#c\"\n")
+
+	p := NewReader(&out)
+	p.Config.Comment = '#'
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a", "#b"}, {"#c"}})
+
+	out.Reset()
+	w = NewWriter(&out)
+	w.Config.Comment, w.Config.Escape, w.Config.PreferEscape = '#', '\\', true
+	t.checkNoErr(w.WriteRow([]string{"#x", "#y"}))
+	t.checkNoErr(w.BeginRow())
+	t.checkNoErr(w.WriteCellFrom(strings.NewReader("#z")))
+	t.checkNoErr(w.EndRow())
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), `\#x,#y`+"\n"+`\#z`+"\n")
+	p = NewReader(&out)
+	p.Config.Comment, p.Config.Escape = '#', '\\'
+	rows, e = p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"#x", "#y"}, {"#z"}})
+
+	// an InlineComment byte is quoted, or escaped
+	for _, escape := range []bool{false, true} {
+		out.Reset()
+		w = NewWriter(&out)
+		w.Config.InlineComment = '#'
+		if escape {
+			w.Config.Escape, w.Config.PreferEscape = '\\', true
+		}
+		t.checkNoErr(w.WriteRow([]string{"a#b", "c"}))
+		t.checkNoErr(w.Flush())
+		if escape {
+			t.checkEq(out.String(), `a\#b,c`+"\n")
+		} else {
+			t.checkEq(out.String(), `"a#b",c`+"\n")
+		}
+		p = NewReader(&out)
+		p.Config = w.Config
+		rows, e = p.ReadAll()
+		t.checkNoErr(e)
+		t.checkEq(rows, [][]string{{"a#b", "c"}})
+	}
+}
+
+func TestFloatFormat(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.FloatFormat = FloatFormat{Fmt: 'f', Prec: 2, NaN: "", PosInf: "inf"}
+	t.checkNoErr(w.WriteRowAny(1234567.891, float32(0.5), 3, math.NaN(), math.Inf(1), math.Inf(-1)))
+	w.Config.FloatFormat.RejectNonFinite = true
+	t.checkEq(w.WriteRowAny(1.0, math.NaN()), ErrNonFinite)
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "1234567.89,0.50,3,NaN,inf,-Inf\n")
+
+	w = NewWriter(&out)
+	w.Config.FloatFormat.Fmt = 'z'
+	_, ok := w.WriteRowAny(1.0).(*ConfigError)
+	t.checkEq(ok, true)
+}
+
+func TestTimeLayout(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	when := time.Date(2024, 3, 1, 23, 30, 0, 0, time.UTC)
+	t.checkNoErr(w.WriteRowAny(when, time.Time{}))
+	w.Config.TimeLayout = "2006-01-02 15:04"
+	w.Config.TimeLocation = time.FixedZone("UTC+1", 3600)
+	w.Config.FormatZeroTime = true
+	t.checkNoErr(w.WriteRowAny(when, time.Time{}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "2024-03-01T23:30:00Z,\n2024-03-02 00:30,0001-01-01 01:00\n")
+}
+
+func TestBoolFormat(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	t.checkNoErr(w.WriteRowAny(true, false))
+	w.Config.BoolFormat = BoolYN
+	t.checkNoErr(w.WriteRowAny(true, false))
+	w.Config.BoolFormat = BoolFormat{"on", "off"}
+	t.checkNoErr(w.WriteRowAny(true, false))
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "true,false\nY,N\non,off\n")
+
+	for in, expected := range map[string]bool{"TRUE": true, "n": false, "1": true, "On": true, "OFF": false} {
+		b, e := w.Config.BoolFormat.parse(in)
+		t.checkNoErr(e)
+		t.checkEq(b, expected)
+	}
+	_, e := w.Config.BoolFormat.parse("yes")
+	t.checkEq(e != nil, true)
+}
+
+func TestWriteAllSeq(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	t.checkNoErr(w.WriteAllSeq(slices.Values([][]string{{"a", "b"}, {"c"}})))
+	t.checkEq(out.String(), "a,b\nc\n")
+
+	out.Reset()
+	w.Config.FieldDelim = ';'
+	t.checkNoErr(w.WriteAllSeq2(Rows(strings.NewReader("a,b\nc,d\n"))))
+	t.checkEq(out.String(), "a;b\nc;d\n")
+
+	out.Reset()
+	t.checkEq(w.WriteAllSeq2(Rows(strings.NewReader("a,b\n\"c"))), io.ErrUnexpectedEOF)
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "a;b\n")
+
+	pulled := 0
+	w = NewWriter(failWriter{})
+	w.Config.Quoting = QuoteNever
+	e := w.WriteAllSeq(func(yield func([]string) bool) {
+		for _, row := range [][]string{{"a"}, {"b,c"}, {"d"}} {
+			pulled += 1
+			if !yield(row) {
+				return
+			}
+		}
+	})
+	t.checkEq(e, &QuoteError{2, 0, "b,c"})
+	t.checkEq(pulled, 2)
+}
+
+func TestWriterReset(tp *testing.T) {
+	t := testHelper{tp}
+	var a, b bytes.Buffer
+	w := NewWriter(&a)
+	w.Config.NoFinalNewline = true
+	t.checkNoErr(w.WriteHeader([]string{"x"}))
+	t.checkNoErr(w.Flush())
+	t.checkNoErr(w.WriteRow([]string{"lost"}))
+	buf := w.buf
+	w.Reset(&b)
+	t.checkEq(w.buf, buf)
+	t.checkNoErr(w.WriteHeader([]string{"y"}))
+	t.checkNoErr(w.WriteRow([]string{"1"}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(a.String(), "x")
+	t.checkEq(b.String(), "y\n1")
+	t.checkEq(w.ByteCount(), int64(3))
+}
+
+func TestWriterResetKeepsHooks(tp *testing.T) {
+	t := testHelper{tp}
+	var a, b bytes.Buffer
+	w := NewWriter(&a)
+	w.SetCellTransform(func(row, col int, name, value string) string {
+		return strings.ToUpper(value)
+	})
+	w.SetFooter(func(n int) []string { return []string{strconv.Itoa(n)} })
+	t.checkNoErr(w.WriteRow([]string{"x"}))
+	t.checkNoErr(w.Close())
+	w.Reset(&b)
+	t.checkNoErr(w.WriteRow([]string{"y"}))
+	t.checkNoErr(w.WriteRow([]string{"z"}))
+	t.checkNoErr(w.Close())
+	t.checkEq(a.String(), "X\n1\n")
+	t.checkEq(b.String(), "Y\nZ\n2\n")
+
+	// a header given to SetHeader is kept, one written is not
+	a.Reset()
+	w = NewWriter(&a)
+	t.checkNoErr(w.WriteHeader([]string{"x", "y"}))
+	w.Reset(&b)
+	t.checkEq(w.WriteRowMap(map[string]string{"x": "1"}), ErrNoHeader)
+	w.SetHeader([]string{"y"})
+	t.checkNoErr(w.WriteHeader([]string{"x", "y"}))
+	w.Reset(&a)
+	t.checkNoErr(w.WriteRowMap(map[string]string{"x": "1", "y": "2"}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(a.String(), "2\n")
+
+	// the file of an OpenAppend Writer is closed by Reset
+	path := filepath.Join(tp.TempDir(), "reset.csv")
+	f, e := OpenAppend(path, DefaultConfig())
+	t.checkNoErr(e)
+	t.checkNoErr(f.WriteRow([]string{"kept"}))
+	t.checkNoErr(f.Flush())
+	t.checkNoErr(f.WriteRow([]string{"lost"}))
+	f.Reset(&b)
+	t.checkNoErr(f.Close())
+	data, e := os.ReadFile(path)
+	t.checkNoErr(e)
+	t.checkEq(string(data), "kept\n")
+}
+
+func TestNewWriterConfig(tp *testing.T) {
+	t := testHelper{tp}
+	config := DefaultConfig()
+	config.QuoteChar = ','
+	_, e := NewWriterConfig(io.Discard, config)
+	t.checkEq(e, config.Validate())
+	t.checkEq(e != nil, true)
+
+	var out bytes.Buffer
+	config.QuoteChar, config.UseCRLF = '\'', true
+	w, e := NewWriterConfig(&out, config)
+	t.checkNoErr(e)
+	t.checkNoErr(w.WriteAll([][]string{{"a,b", "c"}}))
+	t.checkEq(out.String(), "'a,b',c\r\n")
+}
+
+func TestWriterFieldsPerRecord(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.FieldsPerRecord = 0
+	e := w.WriteAll([][]string{{"a", "b"}, {"c", "d"}, {"e"}, {"f", "g"}})
+	t.checkEq(e, &FieldCountError{3, 2, 1})
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "a,b\nc,d\n")
+
+	w = NewWriter(&out)
+	w.Config.FieldsPerRecord = 3
+	t.checkEq(w.WriteRow([]string{"a", "b"}), &FieldCountError{1, 3, 2})
+	t.checkNoErr(w.WriteRow([]string{"a", "b", "c"}))
+}
+
+func TestPadRowsTo(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.PadRowsTo = 3
+	w.Config.Quoting = QuoteAll
+	t.checkNoErr(w.WriteRow([]string{"a"}))
+	t.checkEq(w.WriteRow([]string{"a", "b", "c", "d"}), &FieldCountError{2, 3, 4})
+	w.Config.TruncateRows = true
+	t.checkNoErr(w.WriteRow([]string{"a", "b", "c", "d"}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), `"a","",""`+"\n"+`"a","b","c"`+"\n")
+}
+
+func TestSyncWriter(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	p := NewWriter(&out)
+	p.SetFooter(func(n int) []string { return []string{strconv.Itoa(n), "", ""} })
+	w := NewSyncWriter(p)
+	t.checkNoErr(w.WriteHeader([]string{"x", "y", "z"}))
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			row := []string{strings.Repeat("x", i), "a b", "c,d"}
+			for j := 0; j < 200; j++ {
+				if e := w.WriteRow(row); e != nil {
+					panic(e)
+				}
+				if j%50 == 0 {
+					w.Flush()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	t.checkNoErr(w.Close())
+	t.checkEq(w.WriteAll([][]string{{"a"}}), ErrWriterClosed)
+	rows, e := ReadAll(&out)
+	t.checkNoErr(e)
+	t.checkEq(len(rows), 16*200+2)
+	t.checkEq(rows[0], []string{"x", "y", "z"})
+	t.checkEq(rows[len(rows)-1], []string{"3200", "", ""})
+	for _, row := range rows[1 : len(rows)-1] {
+		t.checkEq(row[1:], []string{"a b", "c,d"})
+	}
+}
+
+func TestGzipWriter(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w, e := NewGzipWriter(&out)
+	t.checkNoErr(e)
+	rows := [][]string{{"a", "b"}, {"c", strings.Repeat("d", 10000)}}
+	t.checkNoErr(w.WriteAll(rows))
+	t.checkNoErr(w.Close())
+	t.checkNoErr(w.Close())
+
+	gz, e := gzip.NewReader(&out)
+	t.checkNoErr(e)
+	read, e := ReadAll(gz)
+	t.checkNoErr(e)
+	t.checkEq(read, rows)
+
+	// Reset ends the stream and starts a new one on the new destination
+	var a, b bytes.Buffer
+	w, e = NewGzipWriter(&a)
+	t.checkNoErr(e)
+	t.checkNoErr(w.WriteRow([]string{"x"}))
+	t.checkNoErr(w.Flush())
+	w.Reset(&b)
+	t.checkNoErr(w.WriteRow([]string{"y"}))
+	t.checkNoErr(w.Close())
+	for _, c := range []struct {
+		out  *bytes.Buffer
+		want [][]string
+	}{{&a, [][]string{{"x"}}}, {&b, [][]string{{"y"}}}} {
+		gz, e := gzip.NewReader(c.out)
+		t.checkNoErr(e)
+		read, e := ReadAll(gz)
+		t.checkNoErr(e)
+		t.checkEq(read, c.want)
+	}
+}
+
+func TestWriterFooter(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	total := 0.0
+	w.SetFooter(func(n int) []string {
+		return []string{"TOTAL", strconv.Itoa(n), strconv.FormatFloat(total, 'f', 2, 64)}
+	})
+	t.checkNoErr(w.WriteHeader([]string{"item", "n", "amount"}))
+	for _, v := range []float64{10.5, 2.25} {
+		total += v
+		t.checkNoErr(w.WriteRowAny("x", 1, v))
+	}
+	t.checkNoErr(w.Close())
+	t.checkNoErr(w.Close())
+	t.checkEq(w.WriteRow([]string{"late"}), ErrWriterClosed)
+	t.checkEq(out.String(), "item,n,amount\nx,1,10.5\nx,1,2.25\nTOTAL,2,12.75\n")
+}
+
+func TestEscapeNewlines(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.EscapeNewlines = true
+	t.checkNoErr(w.WriteAll([][]string{{"a\nb", "c\r\nd\re"}, {`f\ng\`, "h,i"}}))
+	t.checkEq(out.String(), `a\nb,c\nd\re`+"\n"+`f\\ng\\,"h,i"`+"\n")
+
+	p := NewReader(&out)
+	p.Config.EscapeNewlines = true
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"a\nb", "c\nd\re"}, {`f\ng\`, "h,i"}})
+}
+
+func TestSetColumnOrder(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	t.checkNoErr(w.SetColumnOrder([]string{"a", "b", "c"}, []string{"c", "x", "a"}))
+	t.checkNoErr(w.WriteHeader([]string{"a", "b", "c"}))
+	t.checkNoErr(w.WriteRow([]string{"1", "2", "3"}))
+	t.checkNoErr(w.WriteRowMap(map[string]string{"a": "4", "b": "5"}))
+	w.Config.NullString = "NULL"
+	three := "3"
+	t.checkNoErr(w.WriteRowPtr([]*string{nil, nil, &three}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "c,x,a\n3,,1\n,,4\n3,,NULL\n")
+
+	t.checkEq(w.SetColumnOrder([]string{"a", "a"}, nil) != nil, true)
+	t.checkEq(w.SetColumnOrder([]string{"a"}, []string{"b", "b"}) != nil, true)
+}
+
+func TestSetColumnIndices(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.SetColumnIndices([]int{2, 0, 5})
+	t.checkNoErr(w.WriteRow([]string{"a", "b", "c"}))
+	t.checkNoErr(w.WriteRow([]string{"d"}))
+	w.SetColumnIndices(nil)
+	t.checkNoErr(w.WriteRow([]string{"e", "f"}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "c,a,\n,d,\ne,f\n")
+
+	w.SetColumnIndices([]int{1, 0})
+	row := []string{"a", "b"}
+	allocs := testing.AllocsPerRun(100, func() {
+		w.WriteRow(row)
+	})
+	t.checkEq(allocs, 0.0)
+}
+
+func TestSetCellTransform(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.SetCellTransform(func(row, col int, name, value string) string {
+		switch name {
+		case "email":
+			return "<redacted>"
+		case "country":
+			return strings.ToUpper(value)
+		}
+		return fmt.Sprintf("%d:%d:%s", row, col, value)
+	})
+	t.checkNoErr(w.WriteHeader([]string{"id", "email", "country"}))
+	t.checkNoErr(w.WriteRow([]string{"1", "a@b.c", "nz", "x"}))
+	t.checkNoErr(w.WriteRowMap(map[string]string{"country": "de"}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "id,email,country\n2:0:1,<redacted>,NZ,2:3:x\n3:0:,<redacted>,DE\n")
+
+	w.SetCellTransform(nil)
+	row := []string{"a", "b"}
+	allocs := testing.AllocsPerRun(100, func() {
+		w.WriteRow(row)
+	})
+	t.checkEq(allocs, 0.0)
+}
+
+func TestOpenAppend(tp *testing.T) {
+	t := testHelper{tp}
+	dir := tp.TempDir()
+	for _, c := range []struct {
+		existing string
+		expected string
+	}{
+		{"", "c,d\n"},
+		{"a,b", "a,b\nc,d\n"},
+		{"a,b\n", "a,b\nc,d\n"},
+		{"a,b\r\n", "a,b\r\nc,d\n"},
+	} {
+		path := filepath.Join(dir, "out.csv")
+		os.Remove(path)
+		if c.existing != "" {
+			t.checkNoErr(os.WriteFile(path, []byte(c.existing), 0666))
+		}
+		w, e := OpenAppend(path, DefaultConfig())
+		t.checkNoErr(e)
+		t.checkNoErr(w.WriteRow([]string{"c", "d"}))
+		t.checkNoErr(w.Close())
+		b, e := os.ReadFile(path)
+		t.checkNoErr(e)
+		t.checkEq(string(b), c.expected)
+	}
+}
+
+type chunkBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *chunkBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestWriteAllChunked(tp *testing.T) {
+	t := testHelper{tp}
+	var chunks []*chunkBuffer
+	next := func(i int) (io.WriteCloser, error) {
+		if i == 2 {
+			return nil, io.ErrShortWrite
+		}
+		chunks = append(chunks, &chunkBuffer{})
+		return chunks[i], nil
+	}
+	rows := [][]string{{"1"}, {"2"}, {"3"}}
+	t.checkNoErr(WriteAllChunked(slices.Values(rows), []string{"n"}, 2, next))
+	t.checkEq(len(chunks), 2)
+	t.checkEq(chunks[0].String(), "n\n1\n2\n")
+	t.checkEq(chunks[1].String(), "n\n3\n")
+	t.checkEq(chunks[1].closed, true)
+
+	chunks = nil
+	t.checkNoErr(WriteAllChunked(slices.Values([][]string{}), []string{"n"}, 2, next))
+	t.checkEq(chunks[0].String(), "n\n")
+
+	chunks = nil
+	e := WriteAllChunked(slices.Values(append(rows, []string{"4"}, []string{"5"})), nil, 2, next)
+	t.checkEq(e, &ChunkError{2, io.ErrShortWrite})
+	t.checkEq(chunks[1].String(), "3\n4\n")
+	t.checkEq(chunks[1].closed, true)
+}
+
+func TestWriteBOM(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Config.WriteBOM = true
+	t.checkNoErr(w.WriteAll(nil))
+	t.checkEq(out.String(), "\xEF\xBB\xBF")
+	t.checkNoErr(w.WriteAll([][]string{{"é"}, {"b"}}))
+	t.checkEq(out.String(), "\xEF\xBB\xBFé\nb\n")
+	rows, e := ReadAll(&out)
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"é"}, {"b"}})
+
+	w.Reset(&out)
+	t.checkNoErr(w.WriteAll([][]string{{"c"}}))
+	t.checkEq(out.String(), "c\n")
+
+	path := filepath.Join(tp.TempDir(), "bom.csv")
+	t.checkNoErr(os.WriteFile(path, []byte("a,b\n"), 0666))
+	w, e = OpenAppend(path, Config{FieldDelim: ',', FieldsPerRecord: -1, WriteBOM: true})
+	t.checkNoErr(e)
+	t.checkNoErr(w.WriteRow([]string{"1", "2"}))
+	t.checkNoErr(w.Close())
+	b, e := os.ReadFile(path)
+	t.checkNoErr(e)
+	t.checkEq(string(b), "a,b\n1,2\n")
+}
+
+// Yields an endless run of `ab"`.
+type repeatReader struct{ n int }
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = `ab"`[r.n%3]
+		r.n++
+	}
+	return len(p), nil
+}
+
+func TestWriteCellFrom(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	t.checkEq(w.EndRow(), ErrRowOrder)
+	t.checkNoErr(w.BeginRow())
+	t.checkEq(w.WriteRow([]string{"x"}), ErrRowOrder)
+	t.checkNoErr(w.WriteCell("a b"))
+	t.checkNoErr(w.WriteCellFrom(strings.NewReader(`say "hi"`)))
+	t.checkNoErr(w.WriteCell("c,d"))
+	t.checkNoErr(w.EndRow())
+	t.checkNoErr(w.WriteRow([]string{"e"}))
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), `a b,"say ""hi""","c,d"`+"\ne\n")
+	t.checkEq(w.ByteCount(), int64(out.Len()))
+
+	// a field that cannot be written fails the row
+	out.Reset()
+	w = NewWriter(&out)
+	w.Config.Quoting = QuoteNever
+	t.checkNoErr(w.BeginRow())
+	t.checkNoErr(w.WriteCell("a"))
+	qe := &QuoteError{1, 1, "<streamed>"}
+	t.checkEq(w.WriteCellFrom(strings.NewReader("b")), qe)
+	t.checkEq(w.EndRow(), qe)
+	t.checkNoErr(w.BeginRow())
+	t.checkEq(w.WriteCell("c,d") != nil, true)
+	t.checkEq(w.EndRow() != nil, true)
+	t.checkNoErr(w.Flush())
+	t.checkEq(out.String(), "a\n\n")
+
+	w = NewWriter(io.Discard)
+	const size = 100 << 20
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	t.checkNoErr(w.BeginRow())
+	t.checkNoErr(w.WriteCellFrom(io.LimitReader(&repeatReader{}, size)))
+	t.checkNoErr(w.EndRow())
+	t.checkNoErr(w.Flush())
+	runtime.ReadMemStats(&after)
+	t.checkEq(w.ByteCount(), int64(size+size/3+3))
+	t.checkEq(after.TotalAlloc-before.TotalAlloc < 1<<20, true)
+}
+
+func TestWriterStats(tp *testing.T) {
+	t := testHelper{tp}
+	w := NewWriter(io.Discard)
+	w.Config.FieldsPerRecord = -1
+	t.checkNoErr(w.WriteRow([]string{"a", "b,c"}))
+	t.checkNoErr(w.Flush())
+	t.checkNoErr(w.WriteRow([]string{"d", `"e"`, "f"}))
+	t.checkNoErr(w.BeginRow())
+	t.checkNoErr(w.WriteCell("g"))
+	t.checkNoErr(w.WriteCellFrom(strings.NewReader("h")))
+	t.checkNoErr(w.EndRow())
+	t.checkNoErr(w.Flush())
+	t.checkEq(w.Stats(), WriterStats{Rows: 3, Cells: 7, QuotedCells: 3, MaxWidth: 3})
+	w.Reset(io.Discard)
+	t.checkEq(w.Stats(), WriterStats{})
+}
+
+func TestReadRowMap(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("id,name\n1,a\n2\n3,b,x,y\n")
+	m, e := p.ReadRowMap()
+	t.checkNoErr(e)
+	t.checkEq(m, map[string]string{"id": "1", "name": "a"})
+	header, e := p.ReadHeader()
+	t.checkNoErr(e)
+	t.checkEq(header, []string{"id", "name"})
+	m, e = p.ReadRowMap()
+	t.checkNoErr(e)
+	t.checkEq(m, map[string]string{"id": "2", "name": ""})
+	_, e = p.ReadRowMap()
+	t.checkEq(e, &FieldCountError{Row: 4, Expected: 2, Actual: 4})
+	_, e = p.ReadRowMap()
+	t.checkEq(e, io.EOF)
+
+	p = str2Reader("id,name\n3,b,x,y\n")
+	p.Config.ExtraFieldsKey = "_extra"
+	m, e = p.ReadRowMap()
+	t.checkNoErr(e)
+	t.checkEq(m, map[string]string{"id": "3", "name": "b", "_extra": "x,y"})
+
+	p = str2Reader("id,name\n2\n")
+	p.Config.Strict = true
+	_, e = p.ReadRowMap()
+	t.checkEq(e, &FieldCountError{Row: 2, Expected: 2, Actual: 1})
+
+	p = str2Reader("")
+	_, e = p.ReadRowMap()
+	t.checkEq(e, io.EOF)
+}
+
+func TestReadAllMaps(tp *testing.T) {
+	t := testHelper{tp}
+	rows, e := ReadAllMaps(strings.NewReader("a,b\n1,2\n3,4\n"))
+	t.checkNoErr(e)
+	t.checkEq(rows, []map[string]string{{"a": "1", "b": "2"}, {"a": "3", "b": "4"}})
+	rows, e = ReadAllMaps(strings.NewReader("a,b\n"))
+	t.checkNoErr(e)
+	t.checkEq(rows != nil && len(rows) == 0, true)
+	rows, e = ReadAllMaps(strings.NewReader(""))
+	t.checkNoErr(e)
+	t.checkEq(rows != nil && len(rows) == 0, true)
+	_, e = ReadAllMaps(strings.NewReader("a,b\n1,2\n3,\"4\"x\n"))
+	var pe *ParseError
+	t.checkEq(errors.As(e, &pe), true)
+	t.checkEq(pe.Line, 3)
+}
+
+func TestHeaderIndex(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("id,name,id\n1,a,2\n")
+	t.checkEq(p.Header() == nil, true)
+	_, ok := p.HeaderIndex("id")
+	t.checkEq(ok, false)
+	_, e := p.ReadHeader()
+	t.checkNoErr(e)
+	t.checkEq(p.Header(), []string{"id", "name", "id"})
+	i, ok := p.HeaderIndex("name")
+	t.checkEq(i, 1)
+	t.checkEq(ok, true)
+	i, _ = p.HeaderIndex("id")
+	t.checkEq(i, 0)
+	_, ok = p.HeaderIndex("x")
+	t.checkEq(ok, false)
+
+	p.Reset(strings.NewReader("x\n"))
+	t.checkEq(p.Header() == nil, true)
+	_, ok = p.HeaderIndex("name")
+	t.checkEq(ok, false)
+	_, e = p.ReadHeader()
+	t.checkNoErr(e)
+	i, ok = p.HeaderIndex("x")
+	t.checkEq(i, 0)
+	t.checkEq(ok, true)
+}
+
+func TestDuplicateHeaders(tp *testing.T) {
+	t := testHelper{tp}
+	const in = "amount,id,amount,amount_2,amount\n1,x,2,y,3\n"
+	var cases = []struct {
+		policy DuplicateHeaders
+		row    map[string]string
+		err    error
+	}{
+		{DuplicatesKeepFirst, map[string]string{"amount": "1", "id": "x", "amount_2": "y"}, nil},
+		{DuplicatesKeepLast, map[string]string{"amount": "3", "id": "x", "amount_2": "y"}, nil},
+		{DuplicatesError, nil, &DuplicateHeaderError{"amount", []int{0, 2, 4}}},
+		{DuplicatesSuffix, map[string]string{
+			"amount": "1", "id": "x", "amount_3": "2", "amount_2": "y", "amount_4": "3"}, nil},
+	}
+	for _, tc := range cases {
+		p := str2Reader(in)
+		p.Config.DuplicateHeaders = tc.policy
+		m, e := p.ReadRowMap()
+		t.checkEq(e, tc.err)
+		t.checkEq(m, tc.row)
+		if e == nil {
+			t.checkEq(p.Header(), []string{"amount", "id", "amount", "amount_2", "amount"})
+		}
+	}
+	p := str2Reader(in)
+	p.Config.DuplicateHeaders = DuplicatesSuffix
+	_, e := p.ReadHeader()
+	t.checkNoErr(e)
+	i, _ := p.HeaderIndex("amount_4")
+	t.checkEq(i, 4)
+}
+
+func TestHeaderNormalization(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader(" Full   Name ,EMAIL,e-mail \na,b,c\n")
+	p.Config.HeaderNormalization = HeaderFoldCase | HeaderTrimSpace | HeaderCollapseSpace
+	m, e := p.ReadRowMap()
+	t.checkNoErr(e)
+	t.checkEq(m, map[string]string{"full name": "a", "email": "b", "e-mail": "c"})
+	t.checkEq(p.Header(), []string{" Full   Name ", "EMAIL", "e-mail "})
+	i, ok := p.HeaderIndex("Full Name")
+	t.checkEq(i, 0)
+	t.checkEq(ok, true)
+
+	p = str2Reader("Email,e-mail \nb,c\n")
+	p.Config.HeaderNormalization = HeaderFoldCase | HeaderAlphanumeric
+	p.Config.DuplicateHeaders = DuplicatesSuffix
+	m, e = p.ReadRowMap()
+	t.checkNoErr(e)
+	t.checkEq(m, map[string]string{"email": "b", "email2": "c"})
+	i, _ = p.HeaderIndex("E-Mail_2")
+	t.checkEq(i, 1)
+
+	p = str2Reader("Email,EMAIL\n")
+	p.Config.HeaderNormalization = HeaderFoldCase
+	p.Config.DuplicateHeaders = DuplicatesError
+	_, e = p.ReadHeader()
+	t.checkEq(e, &DuplicateHeaderError{"email", []int{0, 1}})
+}
+
+func TestSelectColumns(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("a,b,c,d\n1,2,3,4\n5,6,7,8\n9\n")
+	t.checkEq(p.SelectColumns("a"), ErrNoHeader)
+	_, e := p.ReadHeader()
+	t.checkNoErr(e)
+	t.checkEq(p.SelectColumns("c", "x"), &UnknownColumnError{"x"})
+	t.checkNoErr(p.SelectColumns("d", "b"))
+	row, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(row, []string{"4", "2"})
+	m, e := p.ReadRowMap()
+	t.checkNoErr(e)
+	t.checkEq(m, map[string]string{"b": "6", "d": "8"})
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"", ""}})
+
+	p = str2Reader("a,b,c\n1,\\N,3\n4,5,6\n")
+	p.Config.NullString = `\N`
+	_, e = p.ReadHeader()
+	t.checkNoErr(e)
+	t.checkNoErr(p.SelectColumns("b", "c"))
+	ptrs, e := p.ReadRowPtr()
+	t.checkNoErr(e)
+	t.checkEq(ptrs[0] == nil, true)
+	t.checkEq(*ptrs[1], "3")
+	for row, e := range p.Rows() {
+		t.checkNoErr(e)
+		t.checkEq(row, []string{"5", "6"})
+	}
+	t.checkNoErr(p.SelectColumns())
+
+	p = str2Reader("a,b,c\n1,2,3\n")
+	_, e = p.ReadHeader()
+	t.checkNoErr(e)
+	t.checkNoErr(p.SelectColumns("a"))
+	m, e = p.ReadRowMap()
+	t.checkNoErr(e)
+	t.checkEq(m, map[string]string{"a": "1"})
+
+	// unselected columns are still seen by StopAtPrefix, the row
+	// filter, ExtraFieldsKey and the truncate function
+	p = str2Reader("k,v\n1,2\nEND,x\n3,4\n")
+	p.Config.StopAtPrefix = "END"
+	_, e = p.ReadHeader()
+	t.checkNoErr(e)
+	t.checkNoErr(p.SelectColumns("v"))
+	rows, e = p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"2"}})
+	t.checkEq(p.Footer(), []string{"END", "x"})
+
+	p = str2Reader("k,v\n1,2\n3,4\n")
+	_, e = p.ReadHeader()
+	t.checkNoErr(e)
+	p.SetRowFilter(func(row []string) bool { return row[0] == "3" })
+	t.checkNoErr(p.SelectColumns("v"))
+	rows, e = p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"4"}})
+
+	p = str2Reader("k,v\n1,2,x,y\n")
+	p.Config.FieldsPerRecord = -1
+	p.Config.ExtraFieldsKey = "_extra"
+	_, e = p.ReadHeader()
+	t.checkNoErr(e)
+	t.checkNoErr(p.SelectColumns("k"))
+	m, e = p.ReadRowMap()
+	t.checkNoErr(e)
+	t.checkEq(m, map[string]string{"k": "1", "_extra": "x,y"})
+
+	p = str2Reader("k,v\n1,2,x\n")
+	p.Config.TruncateRows = true
+	var tail []string
+	p.SetTruncateFunc(func(row int, t []string) { tail = t })
+	_, e = p.ReadHeader()
+	t.checkNoErr(e)
+	t.checkNoErr(p.SelectColumns("k"))
+	row, e = p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(row, []string{"1"})
+	t.checkEq(tail, []string{"x"})
+}
+
+func TestSelectIndices(tp *testing.T) {
+	t := testHelper{tp}
+	p := str2Reader("1,2,3\n4,5\n")
+	p.SelectIndices(2, 0, 2)
+	rows, e := p.ReadAll()
+	t.checkNoErr(e)
+	t.checkEq(rows, [][]string{{"3", "1", "3"}, {"", "4", ""}})
+
+	p = str2Reader("1,2\n")
+	p.Config.Strict = true
+	p.SelectIndices(2)
+	_, e = p.ReadRow()
+	t.checkEq(e, &FieldCountError{Row: 1, Expected: 3, Actual: 2})
+
+	p = str2Reader("1,2\n")
+	p.SelectIndices(-1, 1)
+	row, e := p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(row, []string{"", "2"})
+	p = str2Reader("1,2\n")
+	p.Config.Strict = true
+	p.SelectIndices(-1)
+	_, e = p.ReadRow()
+	t.checkEq(e, &FieldCountError{Row: 1, Expected: 0, Actual: 2})
+
+	p = str2Reader("1,2\n3,4\n")
+	p.SelectIndices(1)
+	row, e = p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(row, []string{"2"})
+	p.SelectIndices()
+	row, e = p.ReadRow()
+	t.checkNoErr(e)
+	t.checkEq(row, []string{"3", "4"})
+}
+
+func TestExpectHeader(tp *testing.T) {
+	t := testHelper{tp}
+	var cases = []struct {
+		in   string
+		opts []HeaderOption
+		err  error
+	}{
+		{"id,name,email\n", nil, nil},
+		{"id,email,name\n", nil, &HeaderError{OutOfOrder: []string{"name", "email"}}},
+		{"id,email,name\n", []HeaderOption{IgnoreColumnOrder}, nil},
+		{"id,name,phone\n", nil, &HeaderError{Missing: []string{"email"}, Extra: []string{"phone"}}},
+		{"phone,id,name,email\n", []HeaderOption{AllowExtraColumns}, nil},
+		{"", nil, io.EOF},
+	}
+	for _, tc := range cases {
+		p := str2Reader(tc.in)
+		t.checkEq(p.ExpectHeader([]string{"id", "name", "email"}, tc.opts...), tc.err)
+	}
+	p := str2Reader(" ID ,Name,x\n")
+	p.Config.HeaderNormalization = HeaderFoldCase | HeaderTrimSpace
+	e := p.ExpectHeader([]string{"name", "id"})
+	t.checkEq(e, &HeaderError{Extra: []string{"x"}, OutOfOrder: []string{"name", "id"}})
+	t.checkEq(e.Error(), "header mismatch: unexpected x; out of order name, id")
+}
+
+type product struct {
+	Name    string  `csv:"name"`
+	Price   float64 `csv:"price"`
+	Stock   uint8
+	InStock bool   `csv:"in_stock"`
+	Note    string `csv:"-"`
+	secret  string
+}
+
+func TestUnmarshal(tp *testing.T) {
+	t := testHelper{tp}
+	const in = "name,price,Stock,in_stock,Note,secret,other\n" +
+		"pen,1.5,10,true,n,s,x\n" +
+		"ink,,0,N,n,s,x\n"
+	var products []product
+	t.checkNoErr(Unmarshal(strings.NewReader(in), &products))
+	t.checkEq(products, []product{{"pen", 1.5, 10, true, "", ""}, {"ink", 0, 0, false, "", ""}})
+
+	var ptrs []*product
+	t.checkNoErr(Unmarshal(strings.NewReader("price,name\n2,cap\n"), &ptrs))
+	t.checkEq(ptrs, []*product{{Name: "cap", Price: 2}})
+
+	e := Unmarshal(strings.NewReader("name,price\npen,1\ncap,abc\n"), &products)
+	t.checkEq(e.Error(), `row 3, column price: parsing "abc" as float64: invalid syntax`)
+	var ue *UnmarshalError
+	t.checkEq(errors.As(e, &ue), true)
+	t.checkEq(errors.Is(e, strconv.ErrSyntax), true)
+	e = Unmarshal(strings.NewReader("Stock\n256\n"), &products)
+	t.checkEq(errors.Is(e, strconv.ErrRange), true)
+	products = products[:1]
+	t.checkNoErr(Unmarshal(strings.NewReader(""), &products))
+	t.checkEq(len(products), 1)
+
+	t.checkEq(Unmarshal(strings.NewReader(""), products), &InvalidTypeError{reflect.TypeOf(products)})
+	var ints []int
+	t.checkEq(Unmarshal(strings.NewReader(""), &ints), &InvalidTypeError{reflect.TypeOf(&ints)})
+}
+
+func TestMarshal(tp *testing.T) {
+	t := testHelper{tp}
+	type event struct {
+		Name  string    `csv:"name"`
+		Score float32   `csv:"score"`
+		OK    bool      `csv:"ok"`
+		At    time.Time `csv:"at"`
+		Skip  int       `csv:"-"`
+	}
+	at := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	var out bytes.Buffer
+	t.checkNoErr(Marshal(&out, []event{{"a, b", 0.1, true, at, 1}, {"c", 2, false, time.Time{}, 2}}))
+	t.checkEq(out.String(), "name,score,ok,at\n\"a, b\",0.1,true,2024-05-06T07:08:09Z\nc,2,false,\n")
+
+	out.Reset()
+	w := NewWriter(&out)
+	w.Config.BoolFormat = BoolYN
+	w.Config.TimeLayout = "2006-01-02"
+	t.checkNoErr(w.Marshal([]*event{nil, {Name: "d", OK: true, At: at}}))
+	t.checkEq(out.String(), "name,score,ok,at\nd,0,Y,2024-05-06\n")
+
+	var products []product
+	out.Reset()
+	t.checkNoErr(Marshal(&out, []product{{"pen", 1.5, 10, true, "n", "s"}}))
+	t.checkNoErr(Unmarshal(&out, &products))
+	t.checkEq(products, []product{{"pen", 1.5, 10, true, "", ""}})
+
+	t.checkEq(Marshal(&out, 1), &InvalidTypeError{reflect.TypeOf(1)})
+}
+
+func TestDecoder(tp *testing.T) {
+	t := testHelper{tp}
+	d := NewDecoder(strings.NewReader("name;price\npen;1.5\nink;2\ncap;x\n"))
+	d.Reader().Config.FieldDelim = ';'
+	var p product
+	t.checkNoErr(d.Decode(&p))
+	t.checkEq(p, product{Name: "pen", Price: 1.5})
+	t.checkNoErr(d.Decode(&p))
+	t.checkEq(p, product{Name: "ink", Price: 2})
+	var ue *UnmarshalError
+	t.checkEq(errors.As(d.Decode(&p), &ue), true)
+	t.checkEq(ue.Row, 4)
+	t.checkEq(d.Decode(&p), io.EOF)
+	t.checkEq(d.Decode(p), &InvalidTypeError{reflect.TypeOf(p)})
+
+	r := str2Reader("Stock\n3\n")
+	var other struct{ Stock int }
+	t.checkNoErr(r.Decoder().Decode(&other))
+	t.checkEq(other.Stock, 3)
+}
+
+func TestEncoder(tp *testing.T) {
+	t := testHelper{tp}
+	var out bytes.Buffer
+	en := NewEncoder(&out)
+	en.Writer().Config.UseCRLF = true
+	t.checkNoErr(en.Encode(product{Name: "pen", Price: 1.5}))
+	t.checkNoErr(en.Encode(&product{Name: "ink", InStock: true}))
+	t.checkEq(en.Encode(struct{ Name string }{"x"}), ErrTypeChanged)
+	t.checkEq(en.Encode("x"), &InvalidTypeError{reflect.TypeOf("")})
+	t.checkEq(en.Encode((*product)(nil)), &InvalidTypeError{reflect.TypeOf((*product)(nil))})
+	t.checkEq(out.Len(), 0)
+	t.checkNoErr(en.Flush())
+	t.checkEq(out.String(), "name,price,Stock,in_stock\r\npen,1.5,0,false\r\nink,0,0,true\r\n")
+}
+
+func TestStructTimes(tp *testing.T) {
+	t := testHelper{tp}
+	type record struct {
+		Day     time.Time  `csv:"day,format:2006-01-02"`
+		Stamp   time.Time  `csv:"stamp,format:unix"`
+		Milli   *time.Time `csv:"milli,format:unixmilli"`
+		Created time.Time  `csv:"created"`
+		Label   string     `csv:"label,format:Mon, 02 Jan"`
+	}
+	const in = "day,stamp,milli,created\n" +
+		"2024-05-06,1715000000,1715000000123,2024-05-06T07:08:09+02:00\n" +
+		",,,\n"
+	var records []record
+	t.checkNoErr(Unmarshal(strings.NewReader(in), &records))
+	t.checkEq(len(records), 2)
+	r := records[0]
+	t.checkEq(r.Day, time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC))
+	t.checkEq(r.Stamp.Equal(time.Unix(1715000000, 0)), true)
+	t.checkEq(r.Stamp.Location(), time.UTC)
+	t.checkEq(r.Milli.Equal(time.UnixMilli(1715000000123)), true)
+	t.checkEq(r.Created.Equal(time.Date(2024, 5, 6, 5, 8, 9, 0, time.UTC)), true)
+	t.checkEq(records[1].Day.IsZero(), true)
+	t.checkEq(records[1].Milli == nil, true)
+
+	var out bytes.Buffer
+	t.checkNoErr(Marshal(&out, records))
+	t.checkEq(out.String(), "day,stamp,milli,created,label\n"+
+		"2024-05-06,1715000000,1715000000123,2024-05-06T07:08:09+02:00,\n,,,,\n")
+
+	p := str2Reader("day\n2024-05-06\n")
+	p.Config.TimeLocation = time.FixedZone("X", 3600)
+	t.checkNoErr(p.Unmarshal(&records))
+	t.checkEq(records[2].Day.Equal(time.Date(2024, 5, 5, 23, 0, 0, 0, time.UTC)), true)
+
+	e := Unmarshal(strings.NewReader("stamp\nsoon\n"), &records)
+	t.checkEq(errors.Is(e, strconv.ErrSyntax), true)
+}
+
+func TestStructPointers(tp *testing.T) {
+	t := testHelper{tp}
+	type record struct {
+		Qty   *int    `csv:"qty"`
+		Name  *string `csv:"name"`
+		OK    *bool   `csv:"ok"`
+		Count int     `csv:"count,omitempty"`
+		Flag  bool    `csv:"flag,omitempty"`
+	}
+	var records []record
+	t.checkNoErr(Unmarshal(strings.NewReader("qty,name,ok,count,flag\n3,a,false,0,false\n,,,,\n"), &records))
+	t.checkEq(*records[0].Qty, 3)
+	t.checkEq(*records[0].Name, "a")
+	t.checkEq(records[0].OK != nil && !*records[0].OK, true)
+	t.checkEq(records[1], record{})
+
+	var out bytes.Buffer
+	n := 0
+	t.checkNoErr(Marshal(&out, append(records, record{Qty: &n, Count: 2, Flag: true})))
+	t.checkEq(out.String(), "qty,name,ok,count,flag\n3,a,false,,\n,,,,\n0,,,2,true\n")
+
+	e := Unmarshal(strings.NewReader("ok\nmaybe\n"), &records)
+	t.checkEq(e.Error(), `row 2, column ok: parsing "maybe" as *bool: invalid syntax`)
+}
+
+// A level that reads and writes itself as a name.
+type level int
+
+func (l *level) UnmarshalText(b []byte) error {
+	i := slices.Index([]string{"low", "high"}, string(b))
+	if i < 0 {
+		return fmt.Errorf("unknown level")
+	}
+	*l = level(i)
+	return nil
+}
+
+func (l *level) MarshalText() ([]byte, error) {
+	return []byte([]string{"low", "high"}[*l]), nil
+}
+
+// A point that writes itself as "x:y".
+type point struct{ X, Y int }
+
+func (p point) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d:%d", p.X, p.Y)), nil
+}
+
+func (p *point) UnmarshalText(b []byte) error {
+	_, e := fmt.Sscanf(string(b), "%d:%d", &p.X, &p.Y)
+	return e
+}
+
+func TestStructText(tp *testing.T) {
+	t := testHelper{tp}
+	type record struct {
+		Level level  `csv:"level"`
+		At    point  `csv:"at"`
+		Ptr   *level `csv:"ptr"`
+	}
+	var records []record
+	t.checkNoErr(Unmarshal(strings.NewReader("level,at,ptr\nhigh,1:2,low\n"), &records))
+	t.checkEq(records, []record{{1, point{1, 2}, new(level)}})
+
+	var out bytes.Buffer
+	t.checkNoErr(Marshal(&out, records))
+	t.checkEq(out.String(), "level,at,ptr\nhigh,1:2,low\n")
+	out.Reset()
+	en := NewEncoder(&out)
+	t.checkNoErr(en.Encode(record{Level: 1}))
+	t.checkNoErr(en.Flush())
+	t.checkEq(out.String(), "level,at,ptr\nhigh,0:0,\n")
+
+	e := Unmarshal(strings.NewReader("level\nmid\n"), &records)
+	t.checkEq(e.Error(), `row 2, column level: parsing "mid" as csv.level: unknown level`)
+}
+
+type Address struct {
+	Street string `csv:"street"`
+	City   string `csv:"city"`
+}
+
+type Contact struct {
+	Email string `csv:"email"`
+}
+
+func TestStructEmbedded(tp *testing.T) {
+	t := testHelper{tp}
+	type order struct {
+		ID int `csv:"id"`
+		*Contact
+		Address  `csv:",prefix=billing_"`
+		Shipping *Address `csv:"shipping"`
+	}
+	type shipment struct {
+		ID       int `csv:"id"`
+		*Address `csv:",prefix=to_"`
+	}
+	var orders []order
+	t.checkNoErr(Unmarshal(strings.NewReader("id,email,billing_street,billing_city\n1,a@b,Main St,Oslo\n"), &orders))
+	t.checkEq(orders, []order{{1, &Contact{"a@b"}, Address{"Main St", "Oslo"}, nil}})
+	var shipments []shipment
+	t.checkNoErr(Unmarshal(strings.NewReader("id\n1\n"), &shipments))
+	t.checkEq(shipments, []shipment{{ID: 1}})
+
+	var out bytes.Buffer
+	t.checkNoErr(Marshal(&out, []shipment{{ID: 1}, {2, &Address{"Elm St", "Bergen"}}}))
+	t.checkEq(out.String(), "id,to_street,to_city\n1,,\n2,Elm St,Bergen\n")
+	t.checkNoErr(Unmarshal(&out, &shipments))
+	t.checkEq(shipments[2].Address, &Address{"Elm St", "Bergen"})
+
+	type clash struct {
+		Address
+		City string `csv:"city"`
+	}
+	var clashes []clash
+	t.checkEq(Unmarshal(strings.NewReader("city\nx\n"), &clashes),
+		&FieldCollisionError{reflect.TypeFor[clash](), "city"})
+	t.checkEq(Marshal(&out, clashes), &FieldCollisionError{reflect.TypeFor[clash](), "city"})
+}
+
 func BenchmarkParsing(b *testing.B) {
 	b.StopTimer()
 	str := strings.Repeat("aaaaaaaa,b b b b b b b,\"fo \n oo\",\"c oh c yes c \", ddddd ddd\n", 2000)
@@ -257,3 +2840,31 @@ func BenchmarkParsing(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkWriting(b *testing.B) {
+	row := []string{"a", "bb", "ccc", "1234"}
+	for _, flushEach := range []bool{false, true} {
+		b.Run(fmt.Sprintf("flushEachRow=%v", flushEach), func(b *testing.B) {
+			f, e := os.Create(filepath.Join(b.TempDir(), "out.csv"))
+			if e != nil {
+				panic(e)
+			}
+			defer f.Close()
+			for i := 0; i < b.N; i++ {
+				f.Seek(0, io.SeekStart)
+				w := NewWriter(f)
+				for j := 0; j < 1000000; j++ {
+					if e := w.WriteRow(row); e != nil {
+						panic(e)
+					}
+					if flushEach {
+						w.Flush()
+					}
+				}
+				if e := w.Flush(); e != nil {
+					panic(e)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package csv
+
+import (
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Decodes UTF-16 from br, yielding it as UTF-8 one byte at a time.
+// Unpaired surrogates decode as utf8.RuneError.
+type utf16Reader struct {
+	br        io.ByteReader
+	bigEndian bool
+	out       [utf8.UTFMax]byte
+	n, i      int // out[i:n] is yet to be read
+	next      rune
+	hasNext   bool // next holds a unit read ahead for a surrogate pair
+}
+
+// Reads one UTF-16 code unit.
+func (u *utf16Reader) readUnit() (rune, error) {
+	a, e := u.br.ReadByte()
+	if e != nil {
+		return 0, e
+	}
+	b, e := u.br.ReadByte()
+	if e != nil {
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return 0, e
+	}
+	if u.bigEndian {
+		return rune(a)<<8 | rune(b), nil
+	}
+	return rune(b)<<8 | rune(a), nil
+}
+
+func (u *utf16Reader) ReadByte() (byte, error) {
+	if u.i < u.n {
+		u.i += 1
+		return u.out[u.i-1], nil
+	}
+	var c rune
+	if u.hasNext {
+		c, u.hasNext = u.next, false
+	} else {
+		var e error
+		if c, e = u.readUnit(); e != nil {
+			return 0, e
+		}
+	}
+	if utf16.IsSurrogate(c) {
+		d, e := u.readUnit()
+		if e != nil && e != io.EOF {
+			return 0, e
+		}
+		if c = utf16.DecodeRune(c, d); c == utf8.RuneError && e == nil {
+			// d may start the next character
+			u.next, u.hasNext = d, true
+		}
+	}
+	u.n = utf8.EncodeRune(u.out[:], c)
+	u.i = 1
+	return u.out[0], nil
+}
+
+// Characters for bytes 0x80 to 0x9F in Windows-1252. The five bytes
+// it leaves undefined map to the C1 controls of the same value.
+var windows1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '\u008d', 'Ž', '\u008f',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '\u009d', 'ž', 'Ÿ',
+}
+
+// Decodes s from Windows-1252 to UTF-8.
+func decodeWindows1252(s string) string {
+	buf := make([]byte, 0, len(s)+len(s)/2)
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; {
+		case b < utf8.RuneSelf:
+			buf = append(buf, b)
+		case b < 0xA0:
+			buf = utf8.AppendRune(buf, windows1252[b-0x80])
+		default:
+			buf = utf8.AppendRune(buf, rune(b))
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,559 @@
+package csv
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned when a value is not of a type that can be read into or
+// written from.
+type InvalidTypeError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidTypeError) Error() string {
+	return fmt.Sprintf("cannot use type %v", e.Type)
+}
+
+// Returned when a field cannot be stored in the struct field for its
+// column.
+type UnmarshalError struct {
+	Row    int // 1-based index of the offending row
+	Column string
+	Value  string
+	Type   reflect.Type // of the struct field
+	Err    error
+}
+
+func (e *UnmarshalError) Error() string {
+	return fmt.Sprintf("row %d, column %s: parsing %q as %v: %v", e.Row, e.Column, e.Value, e.Type, e.Err)
+}
+
+func (e *UnmarshalError) Unwrap() error {
+	return e.Err
+}
+
+// Returned for struct fields of a kind that has no conversion.
+var errUnsupportedType = errors.New("unsupported type")
+
+var (
+	timeType          = reflect.TypeFor[time.Time]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// A struct field that maps to a column.
+type structField struct {
+	name   string // of the column
+	index  []int  // as for reflect.Value.FieldByIndex
+	format string // time layout, if set by the tag
+	// whether zero values are written as empty fields
+	omitEmpty bool
+}
+
+// Returned when two fields of a struct type map to the same column.
+type FieldCollisionError struct {
+	Type   reflect.Type
+	Column string
+}
+
+func (e *FieldCollisionError) Error() string {
+	return fmt.Sprintf("%v: more than one field for column %q", e.Type, e.Column)
+}
+
+// Returns the fields of the struct type t that map to columns, in
+// declaration order. A field is named by its `csv` tag, or else by
+// its name. Unexported fields and those tagged `csv:"-"` are left
+// out. A tag option of "format:" sets the layout of a time field, as
+// in `csv:"day,format:2006-01-02"`; it takes up the rest of the tag.
+// The option "omitempty" makes zero values be written as empty
+// fields.
+//
+// The fields of embedded structs, and pointers to them, are taken as
+// fields of t, with names prefixed as set by the option "prefix=" of
+// the embedded field, as in `csv:",prefix=billing_"`. Fields that
+// map to the same column give a *FieldCollisionError.
+func structFields(t reflect.Type) ([]structField, error) {
+	fields := appendFields(nil, t, "", nil, nil)
+	seen := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if seen[f.name] {
+			return nil, &FieldCollisionError{t, f.name}
+		}
+		seen[f.name] = true
+	}
+	return fields, nil
+}
+
+// Appends the fields of the struct type t, reached through the fields
+// at index, with names prefixed by prefix. outer holds the types t is
+// embedded in, so that a type embedding itself is not walked again.
+func appendFields(fields []structField, t reflect.Type, prefix string, index []int, outer []reflect.Type) []structField {
+	outer = append(outer, t)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("csv")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		sf := structField{name: name, index: append(slices.Clip(index), i)}
+		embedded := f.Type
+		if embedded.Kind() == reflect.Pointer {
+			embedded = embedded.Elem()
+		}
+		if f.Anonymous && name == "" && embedded.Kind() == reflect.Struct && embedded != timeType &&
+			!reflect.PointerTo(embedded).Implements(textMarshalerType) {
+			// fields of unexported embedded structs can be set,
+			// unless they are reached through a pointer
+			if (f.IsExported() || f.Type.Kind() != reflect.Pointer) && !slices.Contains(outer, embedded) {
+				var inner string
+				for opts != "" {
+					var opt string
+					opt, opts, _ = strings.Cut(opts, ",")
+					if p, ok := strings.CutPrefix(opt, "prefix="); ok {
+						inner = p
+					}
+				}
+				fields = appendFields(fields, embedded, prefix+inner, sf.index, outer)
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if sf.name == "" {
+			sf.name = f.Name
+		}
+		sf.name = prefix + sf.name
+		for opts != "" {
+			if layout, ok := strings.CutPrefix(opts, "format:"); ok {
+				sf.format = layout
+				break
+			}
+			var opt string
+			opt, opts, _ = strings.Cut(opts, ",")
+			if opt == "omitempty" {
+				sf.omitEmpty = true
+			}
+		}
+		fields = append(fields, sf)
+	}
+	return fields
+}
+
+// Returns the struct type of the elements of a slice of structs or
+// of pointers to structs, and whether they are pointers, or nil if t
+// is no such slice.
+func elemStruct(t reflect.Type) (reflect.Type, bool) {
+	if t.Kind() == reflect.Slice {
+		e := t.Elem()
+		if e.Kind() == reflect.Struct {
+			return e, false
+		}
+		if e.Kind() == reflect.Pointer && e.Elem().Kind() == reflect.Struct {
+			return e.Elem(), true
+		}
+	}
+	return nil, false
+}
+
+// Reads the remaining rows into dest, a pointer to a slice of structs
+// or of pointers to structs, which are appended to it. Columns are
+// matched to struct fields as by HeaderIndex, reading the header
+// first if need be. Columns without a field, and fields without a
+// column, are ignored. Empty input leaves dest as it is. Empty
+// fields give zero values, and nil for pointers; others are converted
+// to string, integer, float, bool and time fields, or newly allocated
+// values for pointers to them, failing with an *UnmarshalError. Fields of types that implement
+// encoding.TextUnmarshaler are parsed by UnmarshalText. Times are parsed
+// with the layout from the tag, or else Config.TimeLayout.
+func (r *Reader) Unmarshal(dest any) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return &InvalidTypeError{reflect.TypeOf(dest)}
+	}
+	slice := v.Elem()
+	t, ptr := elemStruct(slice.Type())
+	if t == nil {
+		return &InvalidTypeError{v.Type()}
+	}
+	fields, e := structFields(t)
+	if e != nil {
+		return e
+	}
+	if _, e = r.ReadHeader(); e == io.EOF {
+		return nil
+	} else if e != nil {
+		return e
+	}
+	cols := r.fieldColumns(fields)
+	for {
+		row, e := r.readFull()
+		if e == io.EOF {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		item := reflect.New(t)
+		if e = r.decodeRow(row, cols, item.Elem()); e != nil {
+			return e
+		}
+		if ptr {
+			slice.Set(reflect.Append(slice, item))
+		} else {
+			slice.Set(reflect.Append(slice, item.Elem()))
+		}
+	}
+}
+
+// Reads the whole CSV file into dest, as by Reader.Unmarshal, with
+// the first row as the header.
+func Unmarshal(r io.Reader, dest any) error {
+	return NewReader(r).Unmarshal(dest)
+}
+
+// A struct field along with the position of its column.
+type fieldColumn struct {
+	structField
+	col int
+}
+
+// Pairs fields with the columns of the header they are read from,
+// leaving out those the header lacks.
+func (r *Reader) fieldColumns(fields []structField) []fieldColumn {
+	var cols []fieldColumn
+	for _, f := range fields {
+		if i, ok := r.HeaderIndex(f.name); ok {
+			cols = append(cols, fieldColumn{f, i})
+		}
+	}
+	return cols
+}
+
+// Stores the fields of row in the struct v.
+func (r *Reader) decodeRow(row []string, cols []fieldColumn, v reflect.Value) error {
+	for _, c := range cols {
+		if c.col >= len(row) {
+			if r.Config.Strict {
+				return &FieldCountError{r.rows, len(r.header), len(row)}
+			}
+			continue
+		}
+		f := fieldToSet(v, c.index)
+		if e := r.decodeField(row[c.col], f, c.format); e != nil {
+			if ne, ok := e.(*strconv.NumError); ok {
+				e = ne.Err
+			}
+			return &UnmarshalError{r.rows, r.header[c.col], row[c.col], f.Type(), e}
+		}
+	}
+	return nil
+}
+
+// Returns the field of the struct v at index, allocating the embedded
+// structs on the way that are nil pointers.
+func fieldToSet(v reflect.Value, index []int) reflect.Value {
+	for k, i := range index {
+		if k > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return v
+}
+
+// Converts s to the type of f and stores it there. Times are parsed
+// with layout, and types that implement encoding.TextUnmarshaler,
+// through a pointer or not, parse s themselves.
+func (r *Reader) decodeField(s string, f reflect.Value, layout string) error {
+	if s == "" {
+		f.SetZero()
+		return nil
+	}
+	if f.Kind() == reflect.Pointer {
+		f.Set(reflect.New(f.Type().Elem()))
+		f = f.Elem()
+	}
+	if f.Type() == timeType {
+		t, e := r.Config.parseTime(s, layout)
+		if e != nil {
+			return e
+		}
+		f.Set(reflect.ValueOf(t))
+		return nil
+	}
+	if u, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, e := strconv.ParseInt(s, 10, f.Type().Bits())
+		if e != nil {
+			return e
+		}
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, e := strconv.ParseUint(s, 10, f.Type().Bits())
+		if e != nil {
+			return e
+		}
+		f.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		x, e := strconv.ParseFloat(s, f.Type().Bits())
+		if e != nil {
+			return e
+		}
+		f.SetFloat(x)
+	case reflect.Bool:
+		b, e := r.Config.BoolFormat.parse(s)
+		if e != nil {
+			return e
+		}
+		f.SetBool(b)
+	default:
+		return errUnsupportedType
+	}
+	return nil
+}
+
+// Writes src, a slice of structs or of pointers to structs, as a
+// header of the names of their fields, as Reader.Unmarshal reads
+// them, followed by a row for each element, and then flushes. Nil
+// elements are skipped. Fields are formatted as by WriteRowAny and
+// written with WriteRow, using MarshalText for types that implement
+// encoding.TextMarshaler. Nil pointer fields, and zero values of
+// those tagged omitempty, are written as empty fields.
+func (w *Writer) Marshal(src any) error {
+	v := reflect.ValueOf(src)
+	if !v.IsValid() {
+		return &InvalidTypeError{nil}
+	}
+	t, ptr := elemStruct(v.Type())
+	if t == nil {
+		return &InvalidTypeError{v.Type()}
+	}
+	fields, e := structFields(t)
+	if e != nil {
+		return e
+	}
+	if e = w.writeFieldNames(fields); e != nil {
+		return e
+	}
+	row := make([]string, len(fields))
+	for i := 0; i < v.Len(); i++ {
+		item := v.Index(i)
+		if ptr {
+			if item.IsNil() {
+				continue
+			}
+			item = item.Elem()
+		}
+		if e := w.writeStruct(item, fields, row); e != nil {
+			return e
+		}
+	}
+	return w.Flush()
+}
+
+// Writes the names of fields as the header.
+func (w *Writer) writeFieldNames(fields []structField) error {
+	header := make([]string, len(fields))
+	for i, f := range fields {
+		header[i] = f.name
+	}
+	return w.WriteHeader(header)
+}
+
+// Writes fields of the struct v as a row, using row for scratch.
+func (w *Writer) writeStruct(v reflect.Value, fields []structField, row []string) error {
+	for k, f := range fields {
+		fv, e := v.FieldByIndexErr(f.index)
+		if e != nil {
+			// inside a nil embedded struct
+			row[k] = ""
+			continue
+		}
+		if f.omitEmpty && fv.IsZero() {
+			row[k] = ""
+			continue
+		}
+		s, e := w.formatField(fv, f.format)
+		if e != nil {
+			return e
+		}
+		row[k] = s
+	}
+	return w.WriteRow(row)
+}
+
+// Writes src to w as by Writer.Marshal, with the default Config.
+func Marshal(w io.Writer, src any) error {
+	return NewWriter(w).Marshal(src)
+}
+
+// Formats the struct field f as WriteRowAny would its value, going by
+// its kind so that named types are formatted like those they are
+// defined as. Times are formatted with layout, nil pointers as empty
+// fields, and types that implement encoding.TextMarshaler, through a
+// pointer or not, by MarshalText.
+func (w *Writer) formatField(f reflect.Value, layout string) (string, error) {
+	if f.Kind() == reflect.Pointer {
+		if f.IsNil() {
+			return "", nil
+		}
+		f = f.Elem()
+	}
+	if f.Type() == timeType {
+		return w.formatTime(f.Interface().(time.Time), layout), nil
+	}
+	if reflect.PointerTo(f.Type()).Implements(textMarshalerType) && !f.Type().Implements(textMarshalerType) {
+		// MarshalText has a pointer receiver
+		if !f.CanAddr() {
+			p := reflect.New(f.Type())
+			p.Elem().Set(f)
+			f = p.Elem()
+		}
+		f = f.Addr()
+	}
+	if m, ok := f.Interface().(encoding.TextMarshaler); ok {
+		b, e := m.MarshalText()
+		return string(b), e
+	}
+	switch f.Kind() {
+	case reflect.String:
+		return f.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(f.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(f.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return w.Config.FloatFormat.format(f.Float(), f.Type().Bits())
+	case reflect.Bool:
+		return w.Config.BoolFormat.format(f.Bool()), nil
+	}
+	return w.formatValue(f.Interface())
+}
+
+// Reads rows into structs one at a time, in the manner of
+// json.Decoder.
+type Decoder struct {
+	r    *Reader
+	t    reflect.Type // struct type cols was worked out for
+	cols []fieldColumn
+}
+
+// Creates a Decoder reading from r with the default Config, which may
+// be changed through Reader before the first call to Decode.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: NewReader(r)}
+}
+
+// Creates a Decoder reading the remaining rows of r, using its
+// Config.
+func (r *Reader) Decoder() *Decoder {
+	return &Decoder{r: r}
+}
+
+// Returns the Reader rows are read from.
+func (d *Decoder) Reader() *Reader {
+	return d.r
+}
+
+// Reads the next row into v, a pointer to a struct, as Reader.Unmarshal
+// does its elements. The header is read by the first call. Returns
+// io.EOF once the input ends. Struct fields are matched to columns
+// once for each type of v.
+func (d *Decoder) Decode(v any) error {
+	p := reflect.ValueOf(v)
+	if p.Kind() != reflect.Pointer || p.IsNil() || p.Elem().Kind() != reflect.Struct {
+		return &InvalidTypeError{reflect.TypeOf(v)}
+	}
+	if _, e := d.r.ReadHeader(); e != nil {
+		return e
+	}
+	if t := p.Elem().Type(); t != d.t {
+		fields, e := structFields(t)
+		if e != nil {
+			return e
+		}
+		d.t, d.cols = t, d.r.fieldColumns(fields)
+	}
+	row, e := d.r.readFull()
+	if e != nil {
+		return e
+	}
+	return d.r.decodeRow(row, d.cols, p.Elem())
+}
+
+// Returned by Encode for a value of another type than the first.
+var ErrTypeChanged = errors.New("value of a different type than the first")
+
+// Writes structs as rows one at a time, in the manner of
+// json.Encoder.
+type Encoder struct {
+	w      *Writer
+	t      reflect.Type // of the first value
+	fields []structField
+	row    []string
+}
+
+// Creates an Encoder writing to w with the default Config, which may
+// be changed through Writer before the first call to Encode.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: NewWriter(w)}
+}
+
+// Creates an Encoder writing to w, using its Config.
+func (w *Writer) Encoder() *Encoder {
+	return &Encoder{w: w}
+}
+
+// Returns the Writer rows are written to.
+func (en *Encoder) Writer() *Writer {
+	return en.w
+}
+
+// Writes v, a struct or a pointer to one, as a row, as Writer.Marshal
+// does its elements. The first call writes the header first. Values
+// of a different type than the first fail with ErrTypeChanged.
+func (en *Encoder) Encode(v any) error {
+	p := reflect.ValueOf(v)
+	if p.Kind() == reflect.Pointer && !p.IsNil() {
+		p = p.Elem()
+	}
+	if p.Kind() != reflect.Struct {
+		return &InvalidTypeError{reflect.TypeOf(v)}
+	}
+	if en.t == nil {
+		fields, e := structFields(p.Type())
+		if e != nil {
+			return e
+		}
+		if e = en.w.writeFieldNames(fields); e != nil {
+			return e
+		}
+		en.t, en.fields = p.Type(), fields
+		en.row = make([]string, len(fields))
+	} else if p.Type() != en.t {
+		return ErrTypeChanged
+	}
+	return en.w.writeStruct(p, en.fields, en.row)
+}
+
+// Writes any buffered rows to the underlying io.Writer.
+func (en *Encoder) Flush() error {
+	return en.w.Flush()
+}
@@ -0,0 +1,90 @@
+package csv
+
+import "sync"
+
+// Wraps a Writer so that it may be used from several goroutines at
+// once. Each row is written whole, without being interleaved with
+// rows from other goroutines. There is no BeginRow, as rows written
+// a field at a time could not be kept whole.
+type SyncWriter struct {
+	mu sync.Mutex
+	w  *Writer
+}
+
+// Creates a SyncWriter writing through w, which should not then be
+// used directly.
+func NewSyncWriter(w *Writer) *SyncWriter {
+	return &SyncWriter{w: w}
+}
+
+// Like Writer.WriteRow.
+func (s *SyncWriter) WriteRow(row []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.WriteRow(row)
+}
+
+// Like Writer.WriteRowAny.
+func (s *SyncWriter) WriteRowAny(cells ...any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.WriteRowAny(cells...)
+}
+
+// Like Writer.WriteRowMap.
+func (s *SyncWriter) WriteRowMap(m map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.WriteRowMap(m)
+}
+
+// Like Writer.WriteRowPtr.
+func (s *SyncWriter) WriteRowPtr(row []*string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.WriteRowPtr(row)
+}
+
+// Like Writer.WriteHeader.
+func (s *SyncWriter) WriteHeader(header []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.WriteHeader(header)
+}
+
+// Like Writer.WriteAll. The rows are written together, without rows
+// from other goroutines among them.
+func (s *SyncWriter) WriteAll(rows [][]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.WriteAll(rows)
+}
+
+// Like Writer.WriteComment.
+func (s *SyncWriter) WriteComment(text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.WriteComment(text)
+}
+
+// Like Writer.Flush.
+func (s *SyncWriter) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Flush()
+}
+
+// Like Writer.Error.
+func (s *SyncWriter) Error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Error()
+}
+
+// Like Writer.Close, writing any footer and ending any gzip stream
+// or file the Writer owns.
+func (s *SyncWriter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
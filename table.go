@@ -0,0 +1,157 @@
+package csv
+
+import (
+	"bufio"
+	"html"
+	"io"
+	"strings"
+)
+
+// Escapes a field for a cell of a Markdown table.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"|", `\|`,
+	"`", "\\`",
+	"\r\n", "<br>",
+	"\r", "<br>",
+	"\n", "<br>",
+)
+
+// Writes header and rows to out as a GitHub-flavored Markdown table.
+// Pipes, backticks and backslashes in fields are escaped, and line
+// breaks become <br>. Rows shorter than header are padded with empty
+// cells, and longer ones fail with a *FieldCountError, counting the
+// header as row 1, before anything is written. An empty header fails
+// with ErrNoHeader.
+func WriteMarkdown(out io.Writer, header []string, rows [][]string) error {
+	if len(header) == 0 {
+		return ErrNoHeader
+	}
+	for i, row := range rows {
+		if len(row) > len(header) {
+			return &FieldCountError{i + 2, len(header), len(row)}
+		}
+	}
+	bw := bufio.NewWriter(out)
+	writeRow := func(row []string, n int) {
+		bw.WriteByte('|')
+		for i := 0; i < max(n, len(row)); i++ {
+			bw.WriteByte(' ')
+			if i < len(row) {
+				markdownEscaper.WriteString(bw, row[i])
+			}
+			bw.WriteString(" |")
+		}
+		bw.WriteByte('\n')
+	}
+	writeRow(header, 0)
+	bw.WriteByte('|')
+	for range header {
+		bw.WriteString(" --- |")
+	}
+	bw.WriteByte('\n')
+	for _, row := range rows {
+		writeRow(row, len(header))
+	}
+	return bw.Flush()
+}
+
+// Writes rows as an HTML table, one row at a time. Close must be
+// called to end the table and flush the output.
+type HTMLWriter struct {
+	out     *bufio.Writer
+	started bool // the <table> tag is written
+	inBody  bool // the <tbody> tag is written
+	closed  bool
+	// When non-empty, the class attribute of the table.
+	Class string
+}
+
+func NewHTMLWriter(w io.Writer) *HTMLWriter {
+	return &HTMLWriter{out: bufio.NewWriter(w)}
+}
+
+// Writes the <table> tag, if not yet written.
+func (w *HTMLWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	if w.Class != "" {
+		w.out.WriteString(`<table class="` + html.EscapeString(w.Class) + `">` + "\n")
+	} else {
+		w.out.WriteString("<table>\n")
+	}
+}
+
+// Writes a row of tag cells, escaping their contents.
+func (w *HTMLWriter) writeCells(tag string, row []string) error {
+	w.out.WriteString("<tr>")
+	for _, cell := range row {
+		w.out.WriteString("<" + tag + ">")
+		w.out.WriteString(html.EscapeString(cell))
+		w.out.WriteString("</" + tag + ">")
+	}
+	_, e := w.out.WriteString("</tr>\n")
+	return e
+}
+
+// Writes header as the head of the table. It must come before any
+// rows.
+func (w *HTMLWriter) WriteHeader(header []string) error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	if w.inBody {
+		return ErrHeaderAfterRows
+	}
+	if w.started {
+		return ErrHeaderWritten
+	}
+	w.start()
+	w.out.WriteString("<thead>\n")
+	w.writeCells("th", header)
+	_, e := w.out.WriteString("</thead>\n")
+	return e
+}
+
+// Writes a row of the body of the table.
+func (w *HTMLWriter) WriteRow(row []string) error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.start()
+	if !w.inBody {
+		w.inBody = true
+		w.out.WriteString("<tbody>\n")
+	}
+	return w.writeCells("td", row)
+}
+
+// Ends the table and flushes the output. Rows can no longer be
+// written after that. Later calls do nothing.
+func (w *HTMLWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.start()
+	if w.inBody {
+		w.out.WriteString("</tbody>\n")
+	}
+	w.out.WriteString("</table>\n")
+	return w.out.Flush()
+}
+
+// Writes header and rows to out as an HTML table with the contents
+// of fields escaped. An empty header is left out.
+func WriteHTML(out io.Writer, header []string, rows [][]string) error {
+	w := NewHTMLWriter(out)
+	if len(header) > 0 {
+		w.WriteHeader(header)
+	}
+	for _, row := range rows {
+		w.WriteRow(row)
+	}
+	return w.Close()
+}